@@ -10,8 +10,10 @@ import (
 	dsb "github.com/ipfs/go-ds-badger"
 	logging "github.com/ipfs/go-log"
 	p2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/connmgr"
 	crypto "github.com/libp2p/go-libp2p-core/crypto"
 	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/metrics"
 	"github.com/libp2p/go-libp2p-core/peer"
 	routing "github.com/libp2p/go-libp2p-core/routing"
 	discovery "github.com/libp2p/go-libp2p-discovery"
@@ -41,6 +43,7 @@ type Helper struct {
 	DiscoveredPeers chan peer.AddrInfo
 	Rendezvous      string
 	Discovery       *discovery.RoutingDiscovery
+	Tracer          *Tracer
 }
 
 type customValidator struct {
@@ -60,7 +63,7 @@ func (cv customValidator) Select(key string, values [][]byte) (int, error) {
 // TODO: just put this into main.go?
 
 // MakeHelper does all the initialization to run one host
-func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Multiaddr, statedir string, pk crypto.PrivKey, networkID string) (*Helper, error) {
+func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Multiaddr, statedir string, pk crypto.PrivKey, networkID string, tracer *Tracer, connMgr connmgr.ConnManager, bwc metrics.Reporter) (*Helper, error) {
 	logger := logging.Logger("codanet.Helper")
 	dso := dsb.DefaultOptions
 
@@ -109,6 +112,9 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 			return as
 		}),
 		p2p.NATPortMap(),
+		p2p.ConnectionManager(connMgr),
+		p2p.Ping(true),
+		p2p.BandwidthReporter(bwc),
 		p2p.Routing(
 			p2pconfig.RoutingC(func(host host.Host) (routing.PeerRouting, error) {
 				kad, err := kad.New(ctx, host, kadopts.Datastore(dsDht), kadopts.Validator(rv))
@@ -123,7 +129,13 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 
 	kad := <-kadch
 
-	pubsub, err := pubsub.NewFloodSub(ctx, host, pubsub.WithStrictSignatureVerification(true), pubsub.WithMessageSigning(true))
+	psOpts := []pubsub.Option{pubsub.WithStrictSignatureVerification(true), pubsub.WithMessageSigning(true)}
+	var gossip *pubsub.PubSub
+	if tracer != nil {
+		gossip, err = pubsub.NewPubSub(ctx, host, newTracingRouter(tracer), psOpts...)
+	} else {
+		gossip, err = pubsub.NewFloodSub(ctx, host, psOpts...)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -134,10 +146,11 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 		Ctx:             ctx,
 		Mdns:            nil,
 		Dht:             kad,
-		Pubsub:          pubsub,
+		Pubsub:          gossip,
 		Logger:          logger,
 		DiscoveredPeers: nil,
 		Rendezvous:      rendezvousString,
 		Discovery:       nil,
+		Tracer:          tracer,
 	}, nil
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	gonet "net"
+	"sync"
+
+	"github.com/go-errors/errors"
+	net "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// allowlistSpec lists the peers a private network talks to, by ID or by the
+// network they connect from.
+type allowlistSpec struct {
+	Peers []string `json:"peers"`
+	CIDRs []string `json:"cidrs"`
+}
+
+// allowlist restricts connections and gossip to a fixed set of peers when
+// enabled. A peer is allowed if its ID is listed, or if it is connected from
+// (or being dialed at) an address in one of the listed networks. Addresses
+// peers advertise for themselves don't count, as they can claim anything.
+type allowlist struct {
+	lock    sync.Mutex
+	enabled bool
+	spec    allowlistSpec
+	peers   map[peer.ID]bool
+	nets    []*gonet.IPNet
+}
+
+// set replaces the allowlist, disabling it if spec is nil.
+func (a *allowlist) set(spec *allowlistSpec) error {
+	if spec == nil {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		a.enabled = false
+		a.spec = allowlistSpec{Peers: []string{}, CIDRs: []string{}}
+		a.peers = nil
+		a.nets = nil
+		return nil
+	}
+
+	peers := make(map[peer.ID]bool, len(spec.Peers))
+	for _, p := range spec.Peers {
+		id, err := peer.IDB58Decode(p)
+		if err != nil {
+			return errors.Errorf("bad peer ID %s: %v", p, err)
+		}
+		peers[id] = true
+	}
+	nets := make([]*gonet.IPNet, len(spec.CIDRs))
+	for i, cidr := range spec.CIDRs {
+		_, ipnet, err := gonet.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets[i] = ipnet
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.enabled = true
+	a.spec = allowlistSpec{Peers: append([]string{}, spec.Peers...), CIDRs: append([]string{}, spec.CIDRs...)}
+	a.peers = peers
+	a.nets = nets
+	return nil
+}
+
+func (a *allowlist) get() (bool, allowlistSpec) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.enabled, a.spec
+}
+
+// allows reports whether p, at one of addrs, may be talked to.
+func (a *allowlist) allows(p peer.ID, addrs []ma.Multiaddr) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.enabled || a.peers[p] {
+		return true
+	}
+	for _, addr := range addrs {
+		if a.inNets(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsConn is allows for the address c actually connects from.
+func (a *allowlist) allowsConn(c net.Conn) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return !a.enabled || a.peers[c.RemotePeer()] || a.inNets(c.RemoteMultiaddr())
+}
+
+// allowsConns reports whether p may be talked to over one of conns.
+func (a *allowlist) allowsConns(p peer.ID, conns []net.Conn) bool {
+	addrs := make([]ma.Multiaddr, len(conns))
+	for i, c := range conns {
+		addrs[i] = c.RemoteMultiaddr()
+	}
+	return a.allows(p, addrs)
+}
+
+// inNets reports whether addr is in a listed network. Callers must hold
+// a.lock.
+func (a *allowlist) inNets(addr ma.Multiaddr) bool {
+	if len(a.nets) == 0 {
+		return false
+	}
+	ipStr, err := addr.ValueForProtocol(ma.P_IP4)
+	if err != nil {
+		ipStr, err = addr.ValueForProtocol(ma.P_IP6)
+	}
+	ip := gonet.ParseIP(ipStr)
+	if err != nil || ip == nil {
+		return false
+	}
+	for _, ipnet := range a.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// gossipAllowed rejects messages authored by peers off the allowlist, which
+// could otherwise reach us through peers on it. Authors allowed only by
+// network must be connected to us directly.
+func (app *app) gossipAllowed(msg *pubsub.Message, msgID string, topic string) bool {
+	from := msg.GetFrom()
+	if from == app.P2p.Host.ID() || app.Allowlist.allowsConns(from, app.P2p.Host.Network().ConnsToPeer(from)) {
+		return true
+	}
+	app.reject(from, msgID, topic, "author not on allowlist")
+	return false
+}
+
+type setAllowlistMsg struct {
+	// Enabled turns allowlist-only mode on or off.
+	Enabled bool `json:"enabled"`
+	allowlistSpec
+}
+
+func (s *setAllowlistMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	spec := &s.allowlistSpec
+	if !s.Enabled {
+		spec = nil
+	}
+	if err := app.Allowlist.set(spec); err != nil {
+		return nil, badRPC(err)
+	}
+	app.closeDisallowedConns()
+	return "setAllowlist success", nil
+}
+
+type getAllowlistMsg struct{}
+
+type getAllowlistResult struct {
+	Enabled bool `json:"enabled"`
+	allowlistSpec
+}
+
+func (g *getAllowlistMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	enabled, spec := app.Allowlist.get()
+	return getAllowlistResult{Enabled: enabled, allowlistSpec: spec}, nil
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/libp2p/go-libp2p-core/metrics"
+	net "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// bandwidthLimits caps stream traffic in bytes per second, per peer and in
+// total, allowing bursts of up to a second's worth. Zero means unlimited.
+type bandwidthLimits struct {
+	PeerIn   float64 `json:"peer_in"`
+	PeerOut  float64 `json:"peer_out"`
+	TotalIn  float64 `json:"total_in"`
+	TotalOut float64 `json:"total_out"`
+	// Pubsub applies the inbound limits to gossip too, dropping messages
+	// over them. Messages we publish are only counted, never held back.
+	Pubsub bool `json:"pubsub"`
+}
+
+func (l bandwidthLimits) validate() error {
+	if l.PeerIn < 0 || l.PeerOut < 0 || l.TotalIn < 0 || l.TotalOut < 0 {
+		return errors.New("bandwidth limits can't be negative")
+	}
+	return nil
+}
+
+func (l bandwidthLimits) limited() bool {
+	return l.PeerIn > 0 || l.PeerOut > 0 || l.TotalIn > 0 || l.TotalOut > 0
+}
+
+// bandwidthChunk is the most a throttled stream writes at once, so that
+// large messages are paced rather than sent in one burst after a long wait.
+const bandwidthChunk = 16 << 10
+
+func newBandwidthBucket(rate float64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{Limit: rateLimit{Rate: rate, Burst: rate}, Tokens: rate, Last: now}
+}
+
+// bandwidthUse is an allowance for one direction, with how long transfers
+// were held back by it.
+type bandwidthUse struct {
+	bucket    *bucket
+	throttled time.Duration
+}
+
+// bandwidthAccount is the allowances of a peer, or of all peers together.
+type bandwidthAccount struct {
+	in, out bandwidthUse
+	// gossip messages dropped for exceeding the inbound limits
+	dropped uint64
+	// bytes of gossip we published, times the peers it was sent to
+	published uint64
+}
+
+func newBandwidthAccount(in float64, out float64, now time.Time) *bandwidthAccount {
+	return &bandwidthAccount{in: bandwidthUse{bucket: newBandwidthBucket(in, now)}, out: bandwidthUse{bucket: newBandwidthBucket(out, now)}}
+}
+
+func (a *bandwidthAccount) use(dir net.Direction) *bandwidthUse {
+	if dir == net.DirInbound {
+		return &a.in
+	}
+	return &a.out
+}
+
+// bandwidthLimiter applies bandwidthLimits to streams, by wrapping them with
+// throttle. As with stream read credit, mplex can't hold back one stream
+// without stalling the whole connection, so inbound limits slow down all
+// traffic with a peer.
+type bandwidthLimiter struct {
+	Limits bandwidthLimits
+
+	lock  sync.Mutex
+	total *bandwidthAccount
+	peers map[peer.ID]*bandwidthAccount
+}
+
+func newBandwidthLimiter(limits *bandwidthLimits) (*bandwidthLimiter, error) {
+	l := &bandwidthLimiter{peers: make(map[peer.ID]*bandwidthAccount)}
+	if limits != nil {
+		if err := limits.validate(); err != nil {
+			return nil, err
+		}
+		l.Limits = *limits
+	}
+	l.total = newBandwidthAccount(l.Limits.TotalIn, l.Limits.TotalOut, time.Now())
+	return l, nil
+}
+
+// accounts returns the allowances p's traffic counts against, p's first.
+// Callers must hold l.lock.
+func (l *bandwidthLimiter) accounts(p peer.ID, now time.Time) []*bandwidthAccount {
+	a, ok := l.peers[p]
+	if !ok {
+		a = newBandwidthAccount(l.Limits.PeerIn, l.Limits.PeerOut, now)
+		l.peers[p] = a
+	}
+	return []*bandwidthAccount{a, l.total}
+}
+
+// reserve charges n bytes to p's allowances for dir, returning how long the
+// caller must wait before transferring them.
+func (l *bandwidthLimiter) reserve(p peer.ID, dir net.Direction, n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	accounts := l.accounts(p, time.Now())
+	delay := l.charge(accounts, dir, n)
+	for _, a := range accounts {
+		a.use(dir).throttled += delay
+	}
+	return delay
+}
+
+// charge removes n bytes from accounts' allowances for dir, returning how
+// long until they are out of debt. Callers must hold l.lock.
+func (l *bandwidthLimiter) charge(accounts []*bandwidthAccount, dir net.Direction, n int) time.Duration {
+	now := time.Now()
+	var delay time.Duration
+	for _, a := range accounts {
+		if b := a.use(dir).bucket; b != nil {
+			if d := b.reserve(now, float64(n)); d > delay {
+				delay = d
+			}
+		}
+	}
+	return delay
+}
+
+// chargeRead charges n bytes read from p to its inbound allowances. Reads
+// have already waited in readAllowance, so any debt holds back the next one.
+func (l *bandwidthLimiter) chargeRead(p peer.ID, n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.charge(l.accounts(p, time.Now()), net.DirInbound, n)
+}
+
+// readAllowance waits until p's inbound allowances have room for a chunk of
+// up to max bytes, and returns how many bytes may be read now.
+func (l *bandwidthLimiter) readAllowance(p peer.ID, max int, done <-chan struct{}) (int, error) {
+	if max > bandwidthChunk {
+		max = bandwidthChunk
+	}
+	for {
+		l.lock.Lock()
+		now := time.Now()
+		accounts := l.accounts(p, now)
+		allowed := float64(max)
+		var delay time.Duration
+		for _, a := range accounts {
+			b := a.in.bucket
+			if b == nil {
+				continue
+			}
+			b.take(now, 0) // refills, so that Tokens is current
+			// waiting for less than a chunk would mean many tiny reads
+			need := math.Min(float64(max), b.Limit.Burst)
+			if b.Tokens < need {
+				if d := time.Duration((need - b.Tokens) / b.Limit.Rate * float64(time.Second)); d > delay {
+					delay = d
+				}
+			} else if b.Tokens < allowed {
+				allowed = b.Tokens
+			}
+		}
+		for _, a := range accounts {
+			a.in.throttled += delay
+		}
+		l.lock.Unlock()
+		if delay <= 0 {
+			return int(allowed), nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return 0, errThrottledReset
+		}
+	}
+}
+
+// refund gives back n bytes reserved but not transferred.
+func (l *bandwidthLimiter) refund(p peer.ID, dir net.Direction, n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, a := range l.accounts(p, time.Now()) {
+		if b := a.use(dir).bucket; b != nil {
+			b.Tokens += float64(n)
+		}
+	}
+}
+
+type bandwidthTimeout struct{}
+
+func (bandwidthTimeout) Error() string   { return "deadline exceeded waiting for bandwidth" }
+func (bandwidthTimeout) Timeout() bool   { return true }
+func (bandwidthTimeout) Temporary() bool { return true }
+
+var errThrottledReset = errors.New("stream reset while waiting for bandwidth")
+
+// wait reserves n bytes for p and waits until they may be transferred. It
+// gives up, refunding them, if that would be after deadline (unless it is
+// zero) or done is closed first.
+func (l *bandwidthLimiter) wait(p peer.ID, dir net.Direction, n int, deadline time.Time, done <-chan struct{}) error {
+	delay := l.reserve(p, dir, n)
+	if delay <= 0 {
+		return nil
+	}
+	var err error
+	if !deadline.IsZero() && time.Until(deadline) < delay {
+		delay, err = time.Until(deadline), bandwidthTimeout{}
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+		err = errThrottledReset
+	}
+	if err != nil {
+		l.refund(p, dir, n)
+	}
+	return err
+}
+
+// admitGossip charges a gossip message of n bytes from p to the inbound
+// allowances, returning false if it exceeds them and should be dropped.
+// Messages larger than a full allowance are admitted when it is full, going
+// into debt as streams do, so that they aren't always dropped.
+func (l *bandwidthLimiter) admitGossip(p peer.ID, n int) bool {
+	if !l.Limits.Pubsub {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	accounts := l.accounts(p, now)
+	for _, a := range accounts {
+		b := a.in.bucket
+		if b == nil {
+			continue
+		}
+		b.take(now, 0) // refills, so that Tokens is current
+		if b.Tokens < math.Min(float64(n), b.Limit.Burst) {
+			for _, a := range accounts {
+				a.dropped++
+			}
+			return false
+		}
+	}
+	for _, a := range accounts {
+		if b := a.in.bucket; b != nil {
+			b.Tokens -= float64(n)
+		}
+	}
+	return true
+}
+
+// countPublish counts n bytes of gossip we published. They aren't charged to
+// the outbound allowance, as pubsub can't be held back and the debt would
+// only stall streams.
+func (l *bandwidthLimiter) countPublish(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.total.published += uint64(n)
+}
+
+// expire forgets peers whose allowances have refilled completely, along with
+// their throttling totals.
+func (l *bandwidthLimiter) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.lock.Lock()
+			for p, a := range l.peers {
+				if refilled(a.in.bucket, now) && refilled(a.out.bucket, now) {
+					delete(l.peers, p)
+				}
+			}
+			l.lock.Unlock()
+		}
+	}
+}
+
+func refilled(b *bucket, now time.Time) bool {
+	return b == nil || b.Tokens+now.Sub(b.Last).Seconds()*b.Limit.Rate >= b.Limit.Burst
+}
+
+// throttle wraps s so that its traffic is held to the limits, if there are
+// any.
+func (l *bandwidthLimiter) throttle(s net.Stream) net.Stream {
+	if l == nil || !l.Limits.limited() {
+		return s
+	}
+	return &throttledStream{Stream: s, limiter: l, peer: s.Conn().RemotePeer(), reset: make(chan struct{})}
+}
+
+// throttledStream waits for bandwidth before each write and read, and reads
+// no more than the allowance left.
+// It keeps track of the stream's deadlines, so that writes waiting for
+// bandwidth time out like any other.
+type throttledStream struct {
+	net.Stream
+	limiter *bandwidthLimiter
+	peer    peer.ID
+	// closed by Reset, to wake up waiting writes
+	reset     chan struct{}
+	resetOnce sync.Once
+
+	lock          sync.Mutex
+	writeDeadline time.Time
+}
+
+func (s *throttledStream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return s.Stream.Read(b)
+	}
+	allowed, err := s.limiter.readAllowance(s.peer, len(b), s.reset)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.Stream.Read(b[:allowed])
+	if n > 0 {
+		s.limiter.chargeRead(s.peer, n)
+	}
+	return n, err
+}
+
+func (s *throttledStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > bandwidthChunk {
+			chunk = chunk[:bandwidthChunk]
+		}
+		s.lock.Lock()
+		deadline := s.writeDeadline
+		s.lock.Unlock()
+		if err := s.limiter.wait(s.peer, net.DirOutbound, len(chunk), deadline, s.reset); err != nil {
+			return written, err
+		}
+		n, err := s.Stream.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (s *throttledStream) Reset() error {
+	s.resetOnce.Do(func() { close(s.reset) })
+	return s.Stream.Reset()
+}
+
+func (s *throttledStream) SetDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline = t
+	s.lock.Unlock()
+	return s.Stream.SetDeadline(t)
+}
+
+func (s *throttledStream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline = t
+	s.lock.Unlock()
+	return s.Stream.SetWriteDeadline(t)
+}
+
+type bandwidthStatsMsg struct{}
+
+// bandwidthUsage is traffic as measured by libp2p, in bytes and bytes per
+// second, and how long the helper held it back.
+type bandwidthUsage struct {
+	BytesIn        int64   `json:"bytes_in"`
+	BytesOut       int64   `json:"bytes_out"`
+	RateIn         float64 `json:"rate_in"`
+	RateOut        float64 `json:"rate_out"`
+	ThrottledInMs  int64   `json:"throttled_in_ms"`
+	ThrottledOutMs int64   `json:"throttled_out_ms"`
+	GossipDropped  uint64  `json:"gossip_dropped"`
+	// only in the total
+	GossipPublished uint64 `json:"gossip_published,omitempty"`
+}
+
+func newBandwidthUsage(s metrics.Stats, a *bandwidthAccount) bandwidthUsage {
+	u := bandwidthUsage{BytesIn: s.TotalIn, BytesOut: s.TotalOut, RateIn: s.RateIn, RateOut: s.RateOut}
+	if a != nil {
+		u.ThrottledInMs = int64(a.in.throttled / time.Millisecond)
+		u.ThrottledOutMs = int64(a.out.throttled / time.Millisecond)
+		u.GossipDropped = a.dropped
+		u.GossipPublished = a.published
+	}
+	return u
+}
+
+type peerBandwidthUsage struct {
+	PeerID string `json:"peer_id"`
+	bandwidthUsage
+}
+
+type bandwidthStatsResult struct {
+	Limits bandwidthLimits `json:"limits"`
+	// Total covers all libp2p traffic, including the DHT and peers no
+	// longer connected.
+	Total bandwidthUsage `json:"total"`
+	// Peers has the connected peers, by peer ID.
+	Peers []peerBandwidthUsage `json:"peers"`
+}
+
+func (bs *bandwidthStatsMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	l := app.Bandwidth
+	peers := app.P2p.Host.Network().Peers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	res := bandwidthStatsResult{
+		Limits: l.Limits,
+		Total:  newBandwidthUsage(app.Metrics.GetBandwidthTotals(), l.total),
+		Peers:  make([]peerBandwidthUsage, 0, len(peers)),
+	}
+	for _, p := range peers {
+		res.Peers = append(res.Peers, peerBandwidthUsage{
+			PeerID:         peer.IDB58Encode(p),
+			bandwidthUsage: newBandwidthUsage(app.Metrics.GetBandwidthForPeer(p), l.peers[p]),
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// bans are kept in this file under the statedir, so they survive restarts
+const bansFile = "bans.json"
+
+type ban struct {
+	PeerID string `json:"peer_id"`
+	Reason string `json:"reason"`
+	// Unix time in milliseconds the ban ends at, zero if it doesn't.
+	ExpiresMs int64 `json:"expires_ms"`
+}
+
+func (b ban) expired(now time.Time) bool {
+	return b.ExpiresMs != 0 && b.ExpiresMs <= now.UnixNano()/int64(time.Millisecond)
+}
+
+// banList is the set of banned peers. gateNotifiee closes their
+// connections, and the helper checks the list before dialing.
+type banList struct {
+	lock sync.Mutex
+	path string
+	bans map[peer.ID]ban
+}
+
+// loadBanList reads the bans saved under statedir, if any. Without a
+// statedir the bans are only kept in memory.
+func loadBanList(statedir string) (*banList, error) {
+	l := &banList{bans: make(map[peer.ID]ban)}
+	if statedir == "" {
+		return l, nil
+	}
+	l.path = path.Join(statedir, bansFile)
+	data, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved []ban
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, errors.Errorf("%s: %v", l.path, err)
+	}
+	for _, b := range saved {
+		id, err := peer.IDB58Decode(b.PeerID)
+		if err != nil {
+			return nil, errors.Errorf("%s: %v", l.path, err)
+		}
+		l.bans[id] = b
+	}
+	return l, nil
+}
+
+// save writes the bans out, if they are kept on disk. Callers must hold
+// l.lock.
+func (l *banList) save() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(l.sorted())
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// sorted returns the unexpired bans by peer ID. Callers must hold l.lock.
+func (l *banList) sorted() []ban {
+	now := time.Now()
+	bans := make([]ban, 0, len(l.bans))
+	for id, b := range l.bans {
+		if b.expired(now) {
+			delete(l.bans, id)
+			continue
+		}
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].PeerID < bans[j].PeerID })
+	return bans
+}
+
+// add bans p for duration, or forever if it is zero, replacing any earlier
+// ban.
+func (l *banList) add(p peer.ID, duration time.Duration, reason string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := ban{PeerID: peer.IDB58Encode(p), Reason: reason}
+	if duration > 0 {
+		b.ExpiresMs = time.Now().Add(duration).UnixNano() / int64(time.Millisecond)
+	}
+	l.bans[p] = b
+	return l.save()
+}
+
+// remove lifts p's ban, returning whether there was one.
+func (l *banList) remove(p peer.ID) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.bans[p]
+	if !ok || b.expired(time.Now()) {
+		return false, nil
+	}
+	delete(l.bans, p)
+	return true, l.save()
+}
+
+func (l *banList) banned(p peer.ID) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.bans[p]
+	return ok && !b.expired(time.Now())
+}
+
+func (l *banList) list() []ban {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.sorted()
+}
+
+type banPeerMsg struct {
+	Peer string `json:"peer"`
+	// zero bans the peer until unbanPeer
+	DurationMs int    `json:"duration_ms"`
+	Reason     string `json:"reason"`
+}
+
+func (b *banPeerMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	id, err := peer.IDB58Decode(b.Peer)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	if err := app.Bans.add(id, time.Duration(b.DurationMs)*time.Millisecond, b.Reason); err != nil {
+		return nil, badHelper(err)
+	}
+	// the ban is saved by now, so failing to close isn't worth failing over
+	if err := app.P2p.Host.Network().ClosePeer(id); err != nil {
+		app.P2p.Logger.Warningf("closing connections to banned peer %s: %v", id.Pretty(), err)
+	}
+	return "banPeer success", nil
+}
+
+type unbanPeerMsg struct {
+	Peer string `json:"peer"`
+}
+
+func (u *unbanPeerMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	id, err := peer.IDB58Decode(u.Peer)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	ok, err := app.Bans.remove(id)
+	if err != nil {
+		return nil, badHelper(err)
+	}
+	if !ok {
+		return nil, badRPC(errors.New("peer isn't banned"))
+	}
+	return "unbanPeer success", nil
+}
+
+type listBansMsg struct{}
+
+func (lb *listBansMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	return app.Bans.list(), nil
+}
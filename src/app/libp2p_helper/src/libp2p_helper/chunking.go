@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"codanet"
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	b58 "github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Pubsub drops RPCs larger than 1MiB. Payloads bigger than maxChunkPayload
+// are split into chunks and published on a companion topic (see chunkTopic),
+// each chunk being an ordinary signed pubsub message. Unchunked payloads stay
+// on the original topic, so nodes that don't know about chunking still
+// interoperate for small messages.
+const (
+	maxChunkPayload = (1 << 20) - (16 << 10)
+	chunkHeaderLen  = blake2b.Size256 + 8
+
+	// chunk validation is cheap until the last chunk of a message arrives,
+	// so don't let one slow upcall throttle (and drop) the chunks behind it.
+	chunkValidatorConcurrency = 64
+
+	defaultMaxChunkedSize  = 32 << 20
+	defaultChunkBufferSize = 128 << 20
+	defaultChunkTimeout    = 30 * time.Second
+)
+
+func chunkTopic(topic string) string {
+	return topic + codanet.ChunkTopicSuffix
+}
+
+type chunk struct {
+	ID    [blake2b.Size256]byte
+	Index uint32
+	Total uint32
+	Data  []byte
+}
+
+// splitChunks splits data into chunks, each identified by the hash of the
+// whole payload so the receiver can check the reassembled message.
+func splitChunks(data []byte) [][]byte {
+	id := blake2b.Sum256(data)
+	total := (len(data) + maxChunkPayload - 1) / maxChunkPayload
+	chunks := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * maxChunkPayload
+		if end > len(data) {
+			end = len(data)
+		}
+		part := data[i*maxChunkPayload : end]
+		buf := make([]byte, chunkHeaderLen+len(part))
+		copy(buf, id[:])
+		binary.BigEndian.PutUint32(buf[blake2b.Size256:], uint32(i))
+		binary.BigEndian.PutUint32(buf[blake2b.Size256+4:], uint32(total))
+		copy(buf[chunkHeaderLen:], part)
+		chunks = append(chunks, buf)
+	}
+	return chunks
+}
+
+// chunkMsgID is the trace ID of the payload c is part of, matching
+// codanet.MessageID of the reassembled payload.
+func chunkMsgID(c chunk) string {
+	return b58.Encode(c.ID[:])
+}
+
+func decodeChunk(buf []byte) (chunk, error) {
+	var c chunk
+	if len(buf) < chunkHeaderLen {
+		return c, errors.New("chunk too short")
+	}
+	copy(c.ID[:], buf)
+	c.Index = binary.BigEndian.Uint32(buf[blake2b.Size256:])
+	c.Total = binary.BigEndian.Uint32(buf[blake2b.Size256+4:])
+	c.Data = buf[chunkHeaderLen:]
+	if c.Total == 0 || c.Index >= c.Total {
+		return c, errors.New("bad chunk index")
+	}
+	if len(c.Data) > maxChunkPayload {
+		return c, errors.New("chunk too large")
+	}
+	return c, nil
+}
+
+type partialMsg struct {
+	Total    uint32
+	Parts    map[uint32][]byte
+	Size     int
+	Deadline time.Time
+}
+
+type reassembledMsg struct {
+	Data     []byte
+	Deadline time.Time
+}
+
+// reassembler buffers chunks until every chunk of a message has arrived.
+// Partial messages are keyed by sender and payload hash, and are dropped
+// after Timeout. Buffered bytes, of partial messages and of reassembled ones
+// awaiting delivery, are bounded by BufferSize.
+type reassembler struct {
+	MaxSize    int
+	BufferSize int
+	Timeout    time.Duration
+
+	lock     sync.Mutex
+	buffered int
+	partial  map[string]*partialMsg
+	// complete holds reassembled payloads between validation of the final
+	// chunk and its delivery to the subscription, keyed by pubsub message ID.
+	complete map[string]reassembledMsg
+}
+
+func newReassembler(maxSize int, bufferSize int, timeout time.Duration) *reassembler {
+	if maxSize <= 0 {
+		maxSize = defaultMaxChunkedSize
+	}
+	if bufferSize <= 0 {
+		bufferSize = defaultChunkBufferSize
+	}
+	if timeout <= 0 {
+		timeout = defaultChunkTimeout
+	}
+	return &reassembler{
+		MaxSize:    maxSize,
+		BufferSize: bufferSize,
+		Timeout:    timeout,
+		partial:    make(map[string]*partialMsg),
+		complete:   make(map[string]reassembledMsg),
+	}
+}
+
+// add records a chunk sent by from. Once the last chunk of a message arrives
+// the reassembled payload is returned.
+func (r *reassembler) add(from peer.ID, c chunk) ([]byte, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if int(c.Total-1)*maxChunkPayload >= r.MaxSize {
+		return nil, errors.New("chunked message too large")
+	}
+
+	key := string(from) + string(c.ID[:])
+	msg, ok := r.partial[key]
+	if !ok {
+		msg = &partialMsg{
+			Total:    c.Total,
+			Parts:    make(map[uint32][]byte),
+			Deadline: time.Now().Add(r.Timeout),
+		}
+		r.partial[key] = msg
+	}
+	if msg.Total != c.Total {
+		return nil, errors.New("chunk total mismatch")
+	}
+	if _, dup := msg.Parts[c.Index]; dup {
+		return nil, errors.New("duplicate chunk")
+	}
+	if r.buffered+len(c.Data) > r.BufferSize {
+		return nil, errors.New("chunk buffer full")
+	}
+	if msg.Size+len(c.Data) > r.MaxSize {
+		return nil, errors.New("chunked message too large")
+	}
+
+	msg.Parts[c.Index] = c.Data
+	msg.Size += len(c.Data)
+	r.buffered += len(c.Data)
+
+	if uint32(len(msg.Parts)) < msg.Total {
+		return nil, nil
+	}
+
+	delete(r.partial, key)
+	r.buffered -= msg.Size
+
+	data := make([]byte, 0, msg.Size)
+	for i := uint32(0); i < msg.Total; i++ {
+		data = append(data, msg.Parts[i]...)
+	}
+	if hash := blake2b.Sum256(data); !bytes.Equal(hash[:], c.ID[:]) {
+		return nil, errors.New("reassembled message hash mismatch")
+	}
+	return data, nil
+}
+
+func pubsubMsgID(msg *pubsub.Message) string {
+	return string(msg.GetFrom()) + string(msg.GetSeqno())
+}
+
+// finish stashes a validated payload until the chunk that completed it is
+// delivered to our subscription.
+func (r *reassembler) finish(msg *pubsub.Message, data []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	id := pubsubMsgID(msg)
+	if _, ok := r.complete[id]; ok {
+		return nil
+	}
+	if r.buffered+len(data) > r.BufferSize {
+		return errors.New("chunk buffer full")
+	}
+	r.buffered += len(data)
+	r.complete[id] = reassembledMsg{Data: data, Deadline: time.Now().Add(r.Timeout)}
+	return nil
+}
+
+// take returns the reassembled payload completed by msg, if any.
+func (r *reassembler) take(msg *pubsub.Message) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	id := pubsubMsgID(msg)
+	m, ok := r.complete[id]
+	if ok {
+		r.buffered -= len(m.Data)
+		delete(r.complete, id)
+	}
+	return m.Data, ok
+}
+
+// expire periodically drops partial messages which timed out, and
+// reassembled ones that were never delivered.
+func (r *reassembler) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.lock.Lock()
+			for key, msg := range r.partial {
+				if now.After(msg.Deadline) {
+					r.buffered -= msg.Size
+					delete(r.partial, key)
+				}
+			}
+			for key, msg := range r.complete {
+				if now.After(msg.Deadline) {
+					r.buffered -= len(msg.Data)
+					delete(r.complete, key)
+				}
+			}
+			r.lock.Unlock()
+		}
+	}
+}
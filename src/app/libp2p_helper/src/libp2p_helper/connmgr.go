@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-errors/errors"
+	connmgr "github.com/libp2p/go-libp2p-connmgr"
+	ifconnmgr "github.com/libp2p/go-libp2p-core/connmgr"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// The connection manager closes connections to the least valuable peers
+// once there are more than the high watermark, until there are only the low
+// watermark left. Connections younger than the grace period are spared.
+const (
+	defaultConnLowWater    = 50
+	defaultConnHighWater   = 200
+	defaultConnGracePeriod = 20 * time.Second
+)
+
+// connManager returns the connection manager configured by m, which does
+// nothing unless a watermark or grace period is set, so that nodes which
+// don't ask for it keep all their connections.
+func (m *configureMsg) connManager() (ifconnmgr.ConnManager, error) {
+	if m.ConnLowWater <= 0 && m.ConnHighWater <= 0 && m.ConnGracePeriodMs <= 0 {
+		return ifconnmgr.NullConnMgr{}, nil
+	}
+	lowWater, highWater := m.ConnLowWater, m.ConnHighWater
+	if lowWater <= 0 {
+		lowWater = defaultConnLowWater
+	}
+	if highWater <= 0 {
+		highWater = defaultConnHighWater
+	}
+	if lowWater > highWater {
+		return nil, errors.Errorf("conn_low_water %d exceeds conn_high_water %d", lowWater, highWater)
+	}
+	return connmgr.NewConnManager(lowWater, highWater, msDuration(m.ConnGracePeriodMs, defaultConnGracePeriod)), nil
+}
+
+// seeds added with addPeer are protected from the connection manager
+const seedTag = "seed"
+
+// how often topic peers' connection manager tags are refreshed
+const topicTagInterval = 10 * time.Second
+
+func topicTag(topic string) string {
+	return "topic:" + topic
+}
+
+// tagTopicPeers tags the peers subscribed to topic with priority, so that
+// the connection manager keeps them over peers we share less with, until ctx
+// is done.
+func (app *app) tagTopicPeers(ctx context.Context, topic string, priority int) {
+	cm := app.P2p.Host.ConnManager()
+	tag := topicTag(topic)
+	tagged := make(map[peer.ID]bool)
+	defer func() {
+		for p := range tagged {
+			cm.UntagPeer(p, tag)
+		}
+	}()
+
+	ticker := time.NewTicker(topicTagInterval)
+	defer ticker.Stop()
+	for {
+		current := make(map[peer.ID]bool)
+		for _, p := range app.P2p.Pubsub.ListPeers(topic) {
+			current[p] = true
+			if !tagged[p] {
+				cm.TagPeer(p, tag, priority)
+			}
+		}
+		for p := range tagged {
+			if !current[p] {
+				cm.UntagPeer(p, tag)
+			}
+		}
+		tagged = current
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	net "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// dialAllowed returns an error if we mustn't connect to p at addrs. Without
+// addrs, libp2p reuses a live connection to p or dials the addresses in the
+// peerstore, so those are checked instead. gateNotifiee still closes the
+// connection if it ends up at an address off the allowlist.
+func (app *app) dialAllowed(p peer.ID, addrs ...ma.Multiaddr) error {
+	if app.Bans.banned(p) {
+		return errors.Errorf("peer %s is banned", p.Pretty())
+	}
+	if until, ok := app.Backoff.until(p); ok {
+		return errors.Errorf("not redialing peer %s until %s", p.Pretty(), until.Format(time.RFC3339))
+	}
+	if len(addrs) == 0 {
+		if conns := app.P2p.Host.Network().ConnsToPeer(p); len(conns) != 0 {
+			addrs = make([]ma.Multiaddr, len(conns))
+			for i, c := range conns {
+				addrs[i] = c.RemoteMultiaddr()
+			}
+		} else {
+			addrs = app.P2p.Host.Peerstore().Addrs(p)
+		}
+	}
+	if !app.Allowlist.allows(p, addrs) {
+		return errors.Errorf("peer %s isn't on the allowlist", p.Pretty())
+	}
+	return nil
+}
+
+// connAllowed returns an error if we mustn't keep the connection c. Peers
+// backing off are refused in both directions, as the DHT dials them without
+// asking dialAllowed and they may reconnect to us themselves.
+func (app *app) connAllowed(c net.Conn) error {
+	p := c.RemotePeer()
+	if app.Bans.banned(p) {
+		return errors.Errorf("peer %s is banned", p.Pretty())
+	}
+	if until, ok := app.Backoff.until(p); ok {
+		return errors.Errorf("peer %s is backing off until %s", p.Pretty(), until.Format(time.RFC3339))
+	}
+	if !app.Allowlist.allowsConn(c) {
+		return errors.Errorf("peer %s at %s isn't on the allowlist", p.Pretty(), c.RemoteMultiaddr())
+	}
+	return nil
+}
+
+// gateNotifiee closes connections the helper mustn't keep, whichever side
+// opened them. libp2p has no way of refusing them before they are set up.
+func gateNotifiee(app *app) net.Notifiee {
+	return &net.NotifyBundle{
+		ConnectedF: func(_ net.Network, c net.Conn) {
+			if err := app.connAllowed(c); err != nil {
+				app.P2p.Logger.Infof("closing connection: %v", err)
+				go c.Close()
+			}
+		},
+	}
+}
+
+// dialBackoff holds peers we disconnected from and shouldn't reconnect to
+// for a while.
+type dialBackoff struct {
+	lock  sync.Mutex
+	peers map[peer.ID]time.Time
+}
+
+func newDialBackoff() *dialBackoff {
+	return &dialBackoff{peers: make(map[peer.ID]time.Time)}
+}
+
+func (b *dialBackoff) add(p peer.ID, d time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.peers[p] = time.Now().Add(d)
+}
+
+// until returns when p may be dialed again, if it is backing off.
+func (b *dialBackoff) until(p peer.ID) (time.Time, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t, ok := b.peers[p]
+	if ok && time.Now().After(t) {
+		delete(b.peers, p)
+		return time.Time{}, false
+	}
+	return t, ok
+}
+
+// closeDisallowedConns closes existing connections after the rules change.
+func (app *app) closeDisallowedConns() {
+	for _, c := range app.P2p.Host.Network().Conns() {
+		if err := app.connAllowed(c); err != nil {
+			app.P2p.Logger.Infof("closing connection: %v", err)
+			c.Close()
+		}
+	}
+}
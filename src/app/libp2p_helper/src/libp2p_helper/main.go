@@ -5,11 +5,13 @@ import (
 	"codanet"
 	"context"
 	cryptorand "crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,6 +21,8 @@ import (
 	logging "github.com/ipfs/go-log"
 	logwriter "github.com/ipfs/go-log/writer"
 	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/helpers"
+	"github.com/libp2p/go-libp2p-core/metrics"
 	net "github.com/libp2p/go-libp2p-core/network"
 	peer "github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/peerstore"
@@ -31,10 +35,11 @@ import (
 )
 
 type subscription struct {
-	Sub    *pubsub.Subscription
-	Idx    int
-	Ctx    context.Context
-	Cancel context.CancelFunc
+	Sub      *pubsub.Subscription
+	ChunkSub *pubsub.Subscription
+	Idx      int
+	Ctx      context.Context
+	Cancel   context.CancelFunc
 }
 
 type app struct {
@@ -42,14 +47,41 @@ type app struct {
 	Ctx        context.Context
 	Subs       map[int]subscription
 	Validators map[int]chan bool
-	Streams    map[int]net.Stream
-	OutLock    sync.Mutex
-	Out        *bufio.Writer
-	RpcLock    sync.Mutex
+	// ValidatorsLock guards Validators, which chunk validators add to
+	// concurrently
+	ValidatorsLock sync.Mutex
+	Streams        map[int]*stream
+	Requests       *pendingRequests
+	// StreamsLock guards Streams, which stream handlers add to, and
+	// StreamLimits
+	StreamsLock  sync.Mutex
+	StreamLimits map[string]*streamLimits
+	Traffic      *trafficStats
+	Bans         *banList
+	Allowlist    *allowlist
+	Conns        *connTracker
+	Backoff      *dialBackoff
+	Persistent   *persistentList
+	Scores       *scoreBook
+	Bandwidth    *bandwidthLimiter
+	// Metrics measures all libp2p traffic, by peer and protocol
+	Metrics *metrics.BandwidthCounter
+	Chunks  *reassembler
+	Limiter *gossipLimiter
+	// initial read credit for new streams, zero if they aren't flow controlled
+	StreamWindow      int
+	StreamIdleTimeout time.Duration
+	OutLock           sync.Mutex
+	Out               *bufio.Writer
+	RpcLock           sync.Mutex
 }
 
 var seqs = make(chan int)
 
+// the longest RPC line the helper reads, enough for the default chunked
+// message limit once base64 encoded
+const maxRPCLineSize = 64 << 20
+
 type methodIdx int
 
 const (
@@ -70,6 +102,25 @@ const (
 	listeningAddrs
 	addPeer
 	beginAdvertising
+	grantStreamCredit
+	closeStreamWrite
+	closeStreamRead
+	listStreams
+	request
+	respond
+	streamStats
+	banPeer
+	unbanPeer
+	listBans
+	setAllowlist
+	getAllowlist
+	listPeers
+	disconnectPeer
+	closeConnection
+	ping
+	persistentPeers
+	peerScores
+	bandwidthStats
 )
 
 type envelope struct {
@@ -104,6 +155,14 @@ type action interface {
 	run(app *app) (interface{}, error)
 }
 
+// asyncAction is implemented by actions which wait on the network. They run
+// in their own goroutine so that other RPCs aren't held up, which means
+// their results may arrive out of order.
+type asyncAction interface {
+	action
+	async()
+}
+
 // TODO: wrap these in a new type, encode them differently in the rpc mainloop
 
 type wrappedError struct {
@@ -147,6 +206,38 @@ type configureMsg struct {
 	NetworkID string   `json:"network_id"`
 	ListenOn  []string `json:"ifaces"`
 	External  string   `json:"external_maddr"`
+	// Limits on reassembly of chunked pubsub messages, zero means default.
+	MaxChunkedSize  int `json:"max_chunked_msg_size"`
+	ChunkBufferSize int `json:"chunk_buffer_size"`
+	ChunkTimeoutMs  int `json:"chunk_timeout_ms"`
+	// Default per-peer, per-topic gossip limit, nil for none.
+	GossipRateLimit    *rateLimit `json:"gossip_rate_limit"`
+	BanAfterViolations int        `json:"ban_after_violations"`
+	// Pubsub events are traced to this file if set.
+	TraceFile string `json:"trace_file"`
+	// Bytes the helper reads from a new stream before waiting for
+	// grantStreamCredit. Zero disables stream flow control.
+	StreamWindow int `json:"stream_read_window"`
+	// Streams are reset if nothing is sent or received for this long, zero
+	// for no idle timeout. openStream and addStreamHandler can override it.
+	StreamIdleTimeoutMs int `json:"stream_idle_timeout_ms"`
+	// Connection manager watermarks and grace period. The connection
+	// manager is only installed if one of them is set, the others then
+	// take their defaults.
+	ConnLowWater      int `json:"conn_low_water"`
+	ConnHighWater     int `json:"conn_high_water"`
+	ConnGracePeriodMs int `json:"conn_grace_period_ms"`
+	// Allowlist, if set, puts the helper in allowlist-only mode: it only
+	// connects to and accepts gossip from the peers listed. setAllowlist
+	// changes it later.
+	Allowlist *allowlistSpec `json:"allowlist"`
+	// PersistentPeers are multiaddrs (with /p2p/<peer ID>) of peers the
+	// helper keeps connected to, see persistentPeers.
+	PersistentPeers []string `json:"persistent_peers"`
+	// Peer scoring weights, decay and thresholds, nil for the defaults.
+	PeerScoring *scoreConfig `json:"peer_scoring"`
+	// Bandwidth caps for streams and optionally pubsub, nil for none.
+	BandwidthLimits *bandwidthLimits `json:"bandwidth_limits"`
 }
 
 type discoveredPeerUpcall struct {
@@ -177,11 +268,61 @@ func (m *configureMsg) run(app *app) (interface{}, error) {
 	if err != nil {
 		return nil, badAddr(err)
 	}
-	helper, err := codanet.MakeHelper(app.Ctx, maddrs, externalMaddr, m.Statedir, privk, m.NetworkID)
+	connMgr, err := m.connManager()
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	var tracer *codanet.Tracer
+	if m.TraceFile != "" {
+		tracer, err = codanet.NewTracer(m.TraceFile)
+		if err != nil {
+			return nil, badHelper(err)
+		}
+	}
+	bans, err := loadBanList(m.Statedir)
+	if err != nil {
+		return nil, badHelper(err)
+	}
+	if err := app.Allowlist.set(m.Allowlist); err != nil {
+		return nil, badRPC(err)
+	}
+	persistent, err := parsePersistentPeers(m.PersistentPeers)
 	if err != nil {
+		return nil, badRPC(err)
+	}
+	scores, err := newScoreBook(m.PeerScoring)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	bandwidth, err := newBandwidthLimiter(m.BandwidthLimits)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	bwc := metrics.NewBandwidthCounter()
+	helper, err := codanet.MakeHelper(app.Ctx, maddrs, externalMaddr, m.Statedir, privk, m.NetworkID, tracer, connMgr, bwc)
+	if err != nil {
+		tracer.Close()
+		connMgr.Close()
 		return nil, badHelper(err)
 	}
 	app.P2p = helper
+	app.Bans = bans
+	app.Persistent = persistent
+	app.Scores = scores
+	app.Bandwidth = bandwidth
+	app.Metrics = bwc
+	helper.Host.Network().Notify(connNotifiee(app))
+	helper.Host.Network().Notify(gateNotifiee(app))
+	app.StreamWindow = m.StreamWindow
+	app.StreamIdleTimeout = time.Duration(m.StreamIdleTimeoutMs) * time.Millisecond
+	app.Chunks = newReassembler(m.MaxChunkedSize, m.ChunkBufferSize, time.Duration(m.ChunkTimeoutMs)*time.Millisecond)
+	go app.Chunks.expire(app.Ctx)
+	app.Limiter = newGossipLimiter(m.GossipRateLimit, m.BanAfterViolations)
+	go app.Limiter.expire(app.Ctx)
+	go app.probeLatency(app.Ctx)
+	app.Persistent.start(app.Ctx, app)
+	go app.creditUptime(app.Ctx)
+	go app.Bandwidth.expire(app.Ctx)
 
 	return "configure success", nil
 }
@@ -214,9 +355,18 @@ func (m *listeningAddrsMsg) run(app *app) (interface{}, error) {
 	return app.P2p.Host.Addrs(), nil
 }
 
+// Pubsub payloads are base64 encoded, unlike other binary data in RPCs. The
+// base58 package takes quadratic time, which for payloads large enough to be
+// chunked runs to many minutes.
 type publishMsg struct {
-	Topic string `json:"topic"`
-	Data  string `json:"data"`
+	Topic        string `json:"topic"`
+	Data         string `json:"data"`
+	RequirePeers bool   `json:"require_peers"`
+}
+
+type publishResult struct {
+	MessageID string `json:"message_id"`
+	Peers     int    `json:"peers"`
 }
 
 func (t *publishMsg) run(app *app) (interface{}, error) {
@@ -227,19 +377,49 @@ func (t *publishMsg) run(app *app) (interface{}, error) {
 		return nil, needsDHT()
 	}
 
-	data, err := b58.Decode(t.Data)
+	data, err := base64.StdEncoding.DecodeString(t.Data)
 	if err != nil {
 		return nil, badRPC(err)
 	}
-	if err := app.P2p.Pubsub.Publish(t.Topic, data); err != nil {
-		return nil, badp2p(err)
+
+	topic := t.Topic
+	chunks := [][]byte{data}
+	if len(data) > maxChunkPayload {
+		topic = chunkTopic(t.Topic)
+		chunks = splitChunks(data)
+	}
+
+	// floodsub forwards our own messages to every peer subscribed to the topic
+	peers := len(app.P2p.Pubsub.ListPeers(topic))
+	if peers == 0 && t.RequirePeers {
+		return nil, badp2p(errors.New("no peers subscribed to topic"))
+	}
+
+	msgID := codanet.MessageID(data)
+	app.P2p.Tracer.Trace(codanet.TraceEvent{Type: "publish", MsgID: msgID, Topic: t.Topic})
+	app.Bandwidth.countPublish(len(data) * peers)
+	for _, c := range chunks {
+		if err := app.P2p.Pubsub.Publish(topic, c); err != nil {
+			return nil, badp2p(err)
+		}
 	}
-	return "publish success", nil
+	return publishResult{MessageID: msgID, Peers: peers}, nil
 }
 
 type subscribeMsg struct {
 	Topic        string `json:"topic"`
 	Subscription int    `json:"subscription_idx"`
+	// overrides the configured gossip_rate_limit for this topic
+	RateLimit *rateLimit `json:"rate_limit"`
+	// RelayOnly joins the topic to help propagate messages without
+	// delivering them to the coda process. Relayed messages are only
+	// validated if ValidateRelayed is set.
+	RelayOnly       bool `json:"relay_only"`
+	ValidateRelayed bool `json:"validate_relayed"`
+	// ConnPriority, if positive, tags the topic's peers so that the
+	// connection manager prefers keeping them. Use it for topics such as
+	// blocks which we can't afford to lose peers on.
+	ConnPriority int `json:"conn_priority"`
 }
 
 type publishUpcall struct {
@@ -248,6 +428,145 @@ type publishUpcall struct {
 	Data         string `json:"data"`
 }
 
+// reject traces the message msgID from id being rejected. Chunks are
+// traced under the ID of the whole payload, see chunkMsgID.
+func (app *app) reject(id peer.ID, msgID string, topic string, reason string) {
+	app.P2p.Tracer.Trace(codanet.TraceEvent{Type: "reject", MsgID: msgID, Topic: topic, Peer: id.Pretty(), Reason: reason})
+}
+
+// validate asks the coda process whether a message received from id on
+// subscription idx is valid.
+func (app *app) validate(ctx context.Context, id peer.ID, data []byte, topic string, idx int) bool {
+	seqno := <-seqs
+	// buffered, so that validationComplete doesn't block if we time out
+	ch := make(chan bool, 1)
+	app.ValidatorsLock.Lock()
+	app.Validators[seqno] = ch
+	app.ValidatorsLock.Unlock()
+	app.writeMsg(validateUpcall{
+		PeerID: id.Pretty(),
+		Data:   base64.StdEncoding.EncodeToString(data),
+		Seqno:  seqno,
+		Upcall: "validate",
+		Idx:    idx,
+	})
+
+	// Wait for the validation response, but be sure to honor any timeout/deadline in ctx
+	select {
+	case <-ctx.Done():
+		// do NOT delete app.Validators[seqno] here! the ocaml side doesn't
+		// care about the timeout and will validate it anyway.
+		// validationComplete will remove app.Validators[seqno] once the
+		// coda process gets around to it.
+		app.reject(id, codanet.MessageID(data), topic, "validation timed out")
+		return false
+	case res := <-ch:
+		if !res {
+			app.reject(id, codanet.MessageID(data), topic, "invalid")
+		}
+		app.scoreValidation(id, res)
+		return res
+	}
+}
+
+// allowGossip applies the gossip rate limit to a message of size bytes from
+// id, reporting and possibly blacklisting peers that exceed it.
+func (app *app) allowGossip(id peer.ID, msgID string, size int, topic string, cost float64) bool {
+	if id == app.P2p.Host.ID() {
+		return true
+	}
+	if !app.Bandwidth.admitGossip(id, size) {
+		app.reject(id, msgID, topic, "over bandwidth limit")
+		return false
+	}
+	ok, violations := app.Limiter.allow(id, topic, cost)
+	if ok {
+		return true
+	}
+	app.P2p.Logger.Warningf("peer %s exceeded gossip rate limit on %s (%d violations)", id.Pretty(), topic, violations)
+	app.reject(id, msgID, topic, "rate limited")
+	app.scoreRateLimited(id)
+	if app.Limiter.BanAfter > 0 && violations == app.Limiter.BanAfter {
+		app.P2p.Logger.Warningf("blacklisting peer %s for exceeding gossip rate limits", id.Pretty())
+		app.P2p.Pubsub.BlacklistPeer(id)
+	}
+	return false
+}
+
+// validateChunk buffers a chunk of a larger message. Chunks are relayed as
+// they arrive, but the chunk completing a message is only accepted (and so
+// only relayed) if the reassembled message is valid.
+func (app *app) validateChunk(ctx context.Context, id peer.ID, msg *pubsub.Message, topic string, idx int, validate bool) bool {
+	c, err := decodeChunk(msg.Data)
+	if err != nil {
+		app.P2p.Logger.Warningf("dropping chunk from %s: %v", id.Pretty(), err)
+		app.reject(id, codanet.MessageID(msg.Data), topic, err.Error())
+		return false
+	}
+	msgID := chunkMsgID(c)
+	if !app.gossipAllowed(msg, msgID, topic) {
+		return false
+	}
+	// a whole chunked message counts as one message against the limit
+	if !app.allowGossip(id, msgID, len(msg.Data), topic, 1/float64(c.Total)) {
+		return false
+	}
+	if !validate {
+		return true
+	}
+	data, err := app.Chunks.add(msg.GetFrom(), c)
+	if err != nil {
+		app.P2p.Logger.Warningf("dropping chunk from %s: %v", id.Pretty(), err)
+		app.reject(id, msgID, topic, err.Error())
+		return false
+	}
+	if data == nil {
+		return true
+	}
+	if !app.validate(ctx, id, data, topic, idx) {
+		return false
+	}
+	if err := app.Chunks.finish(msg, data); err != nil {
+		app.P2p.Logger.Warningf("dropping chunked message from %s: %v", id.Pretty(), err)
+		app.reject(id, msgID, topic, err.Error())
+		return false
+	}
+	return true
+}
+
+// deliver sends messages from sub to the coda process until ctx is
+// cancelled. For chunk subscriptions only reassembled messages are sent, and
+// for relay-only subscriptions messages are just drained.
+func (app *app) deliver(ctx context.Context, sub *pubsub.Subscription, topic string, idx int, chunked bool, relayOnly bool) {
+	for {
+		msg, err := sub.Next(ctx)
+		if err == nil {
+			data := msg.Data
+			if chunked {
+				var ok bool
+				if data, ok = app.Chunks.take(msg); !ok {
+					continue
+				}
+			}
+			if relayOnly {
+				continue
+			}
+			app.P2p.Tracer.Trace(codanet.TraceEvent{Type: "deliver", MsgID: codanet.MessageID(data), Topic: topic, Peer: peer.ID(msg.GetFrom()).Pretty()})
+			app.writeMsg(publishUpcall{
+				Upcall:       "publish",
+				Subscription: idx,
+				Data:         base64.StdEncoding.EncodeToString(data),
+			})
+		} else {
+			if ctx.Err() != context.Canceled {
+				log.Print("sub.Next failed: ", err)
+			} else {
+				break
+			}
+		}
+	}
+}
+
 func (s *subscribeMsg) run(app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
@@ -255,65 +574,54 @@ func (s *subscribeMsg) run(app *app) (interface{}, error) {
 	if app.P2p.Dht == nil {
 		return nil, needsDHT()
 	}
-	err := app.P2p.Pubsub.RegisterTopicValidator(s.Topic, func(ctx context.Context, id peer.ID, msg *pubsub.Message) bool {
-		seqno := <-seqs
-		ch := make(chan bool)
-		app.Validators[seqno] = ch
-		app.writeMsg(validateUpcall{
-			PeerID: id.Pretty(),
-			Data:   b58.Encode(msg.Data),
-			Seqno:  seqno,
-			Upcall: "validate",
-			Idx:    s.Subscription,
-		})
+	app.Limiter.setTopicLimit(s.Topic, s.RateLimit)
+	validate := !s.RelayOnly || s.ValidateRelayed
 
-		// Wait for the validation response, but be sure to honor any timeout/deadline in ctx
-		select {
-		case <-ctx.Done():
-			// do NOT delete app.Validators[seqno] here! the ocaml side doesn't
-			// care about the timeout and will validate it anyway.
-			// validationComplete will remove app.Validators[seqno] once the
-			// coda process gets around to it.
+	err := app.P2p.Pubsub.RegisterTopicValidator(s.Topic, func(ctx context.Context, id peer.ID, msg *pubsub.Message) bool {
+		msgID := codanet.MessageID(msg.Data)
+		if !app.gossipAllowed(msg, msgID, s.Topic) || !app.allowGossip(id, msgID, len(msg.Data), s.Topic, 1) {
 			return false
-		case res := <-ch:
-			return res
 		}
+		if !validate {
+			return true
+		}
+		return app.validate(ctx, id, msg.Data, s.Topic, s.Subscription)
 	}, pubsub.WithValidatorConcurrency(1), pubsub.WithValidatorTimeout(5*time.Second))
 
 	if err != nil {
 		return nil, badp2p(err)
 	}
 
+	err = app.P2p.Pubsub.RegisterTopicValidator(chunkTopic(s.Topic), func(ctx context.Context, id peer.ID, msg *pubsub.Message) bool {
+		return app.validateChunk(ctx, id, msg, s.Topic, s.Subscription, validate)
+	}, pubsub.WithValidatorConcurrency(chunkValidatorConcurrency), pubsub.WithValidatorTimeout(5*time.Second))
+
+	if err != nil {
+		return nil, badp2p(err)
+	}
+
 	sub, err := app.P2p.Pubsub.Subscribe(s.Topic)
 	if err != nil {
 		return nil, badp2p(err)
 	}
+	chunkSub, err := app.P2p.Pubsub.Subscribe(chunkTopic(s.Topic))
+	if err != nil {
+		sub.Cancel()
+		return nil, badp2p(err)
+	}
 	ctx, cancel := context.WithCancel(app.Ctx)
 	app.Subs[s.Subscription] = subscription{
-		Sub:    sub,
-		Idx:    s.Subscription,
-		Ctx:    ctx,
-		Cancel: cancel,
+		Sub:      sub,
+		ChunkSub: chunkSub,
+		Idx:      s.Subscription,
+		Ctx:      ctx,
+		Cancel:   cancel,
+	}
+	go app.deliver(ctx, sub, s.Topic, s.Subscription, false, s.RelayOnly)
+	go app.deliver(ctx, chunkSub, s.Topic, s.Subscription, true, s.RelayOnly)
+	if s.ConnPriority > 0 {
+		go app.tagTopicPeers(ctx, s.Topic, s.ConnPriority)
 	}
-	go func() {
-		for {
-			msg, err := sub.Next(ctx)
-			if err == nil {
-				data := b58.Encode(msg.Data)
-				app.writeMsg(publishUpcall{
-					Upcall:       "publish",
-					Subscription: s.Subscription,
-					Data:         data,
-				})
-			} else {
-				if ctx.Err() != context.Canceled {
-					log.Print("sub.Next failed: ", err)
-				} else {
-					break
-				}
-			}
-		}
-	}()
 	return "subscribe success", nil
 }
 
@@ -327,6 +635,7 @@ func (u *unsubscribeMsg) run(app *app) (interface{}, error) {
 	}
 	if sub, ok := app.Subs[u.Subscription]; ok {
 		sub.Sub.Cancel()
+		sub.ChunkSub.Cancel()
 		sub.Cancel()
 		return "unsubscribe success", nil
 	}
@@ -350,9 +659,12 @@ func (r *validationCompleteMsg) run(app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
-	if ch, ok := app.Validators[r.Seqno]; ok {
+	app.ValidatorsLock.Lock()
+	ch, ok := app.Validators[r.Seqno]
+	delete(app.Validators, r.Seqno)
+	app.ValidatorsLock.Unlock()
+	if ok {
 		ch <- r.Valid
-		delete(app.Validators, r.Seqno)
 		return "validationComplete success", nil
 	}
 	return nil, badRPC(errors.New("validation seqno unknown"))
@@ -391,12 +703,19 @@ func (*generateKeypairMsg) run(app *app) (interface{}, error) {
 }
 
 type streamLostUpcall struct {
-	Upcall    string `json:"upcall"`
-	StreamIdx int    `json:"stream_idx"`
-	Reason    string `json:"reason"`
+	Upcall    string        `json:"upcall"`
+	StreamIdx int           `json:"stream_idx"`
+	Reason    string        `json:"reason"`
+	Stats     trafficCounts `json:"stats"`
 }
 
 type streamReadCompleteUpcall struct {
+	Upcall    string        `json:"upcall"`
+	StreamIdx int           `json:"stream_idx"`
+	Stats     trafficCounts `json:"stats"`
+}
+
+type streamRemoteClosedUpcall struct {
 	Upcall    string `json:"upcall"`
 	StreamIdx int    `json:"stream_idx"`
 }
@@ -404,6 +723,18 @@ type streamReadCompleteUpcall struct {
 type openStreamMsg struct {
 	Peer       string `json:"peer"`
 	ProtocolID string `json:"protocol"`
+	// Protocols to try in order of preference, instead of ProtocolID
+	Protocols []string `json:"protocols"`
+	// non-zero to frame messages on the stream, see stream.MaxFrame
+	MaxFrameSize int `json:"max_frame_size"`
+	// deadline for opening the stream, zero for defaultOpenStreamTimeout
+	TimeoutMs     int `json:"timeout_ms"`
+	IdleTimeoutMs int `json:"idle_timeout_ms"`
+	// Addrs to dial the peer at, which needn't be known to the peerstore
+	// yet. They are kept in the peerstore for AddrTTLMs, or
+	// peerstore.TempAddrTTL if zero.
+	Addrs     []string `json:"addrs"`
+	AddrTTLMs int      `json:"addr_ttl_ms"`
 }
 
 type incomingMsgUpcall struct {
@@ -412,36 +743,62 @@ type incomingMsgUpcall struct {
 	Data      string `json:"data"`
 }
 
-func handleStreamReads(app *app, stream net.Stream, idx int) {
-	go func() {
-		buf := make([]byte, 4096)
-		for {
-			len, err := stream.Read(buf)
+// streamOpts combines per-stream settings from an RPC with the configured
+// defaults.
+func (app *app) streamOpts(maxFrame int, idleTimeoutMs int) streamOpts {
+	idle := app.StreamIdleTimeout
+	if idleTimeoutMs > 0 {
+		idle = time.Duration(idleTimeoutMs) * time.Millisecond
+	}
+	return streamOpts{MaxFrame: maxFrame, Window: app.StreamWindow, IdleTimeout: idle, Bandwidth: app.Bandwidth}
+}
 
-			if len != 0 {
-				app.writeMsg(incomingMsgUpcall{
-					Upcall:    "incomingStreamMsg",
-					Data:      b58.Encode(buf[:len]),
-					StreamIdx: idx,
-				})
+func handleStreamReads(app *app, stream *stream) {
+	go func() {
+		err := stream.readMsgs(func(msg []byte) {
+			if stream.isReadClosed() {
+				return
 			}
+			app.writeMsg(incomingMsgUpcall{
+				Upcall:    "incomingStreamMsg",
+				Data:      b58.Encode(msg),
+				StreamIdx: stream.Idx,
+			})
+		})
 
-			if err != nil && err != io.EOF {
-				app.writeMsg(streamLostUpcall{
-					Upcall:    "streamLost",
-					StreamIdx: idx,
-					Reason:    fmt.Sprintf("read failure: %s", err.Error()),
-				})
-				break
-			}
+		if tooLarge, ok := err.(frameTooLarge); ok {
+			stream.abort(fmt.Sprintf("oversized frame: %s", tooLarge.Error()))
+		}
 
-			if err == io.EOF {
-				break
+		if err == io.EOF {
+			stream.setRemoteClosed()
+			app.removeIfClosed(stream)
+			app.writeMsg(streamRemoteClosedUpcall{
+				Upcall:    "streamRemoteClosed",
+				StreamIdx: stream.Idx,
+			})
+		} else {
+			reason := stream.lostReason()
+			// only the peer is to blame if we didn't reset the stream
+			// or close its connection ourselves
+			if reason == "" && app.connOpen(stream.Conn()) {
+				app.scoreStreamError(stream.Conn().RemotePeer())
 			}
+			if reason == "" {
+				reason = fmt.Sprintf("read failure: %s", err.Error())
+			}
+			app.streamLost(stream, reason)
+		}
+
+		if reason := stream.finishReading(); reason != "" && err == io.EOF {
+			// aborted after the remote closed, so not reported above
+			app.streamLost(stream, reason)
 		}
+
 		app.writeMsg(streamReadCompleteUpcall{
 			Upcall:    "streamReadComplete",
-			StreamIdx: idx,
+			StreamIdx: stream.Idx,
+			Stats:     stream.stats(),
 		})
 	}()
 }
@@ -450,6 +807,8 @@ type openStreamResult struct {
 	StreamIdx    int    `json:"stream_idx"`
 	RemoteAddr   string `json:"remote_addr"`
 	RemotePeerID string `json:"remote_peerid"`
+	// the protocol negotiated with the remote
+	Protocol string `json:"protocol"`
 }
 
 func (o *openStreamMsg) run(app *app) (interface{}, error) {
@@ -457,38 +816,85 @@ func (o *openStreamMsg) run(app *app) (interface{}, error) {
 		return nil, needsConfigure()
 	}
 	streamIdx := <-seqs
-	peer, err := peer.IDB58Decode(o.Peer)
+	peerID, err := peer.IDB58Decode(o.Peer)
 	if err != nil {
 		// TODO: this isn't necessarily an RPC error. Perhaps the encoded Peer ID
 		// isn't supported by this version of libp2p.
 		return nil, badRPC(err)
 	}
 
-	stream, err := app.P2p.Host.NewStream(app.Ctx, peer, protocol.ID(o.ProtocolID))
+	addrs := make([]multiaddr.Multiaddr, 0, len(o.Addrs))
+	for _, a := range o.Addrs {
+		maddr, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, badRPC(err)
+		}
+		transport, id := peer.SplitAddr(maddr)
+		if transport == nil {
+			return nil, badRPC(errors.Errorf("address %s has no transport part", a))
+		}
+		if id != "" && id != peerID {
+			return nil, badRPC(errors.Errorf("address %s is for a different peer", a))
+		}
+		addrs = append(addrs, transport)
+	}
+	if err := app.dialAllowed(peerID, addrs...); err != nil {
+		return nil, badp2p(err)
+	}
+
+	var pids []protocol.ID
+	if len(o.Protocols) > 0 {
+		for _, p := range o.Protocols {
+			pids = append(pids, protocol.ID(p))
+		}
+	} else {
+		pids = []protocol.ID{protocol.ID(o.ProtocolID)}
+	}
+
+	timeout := defaultOpenStreamTimeout
+	if o.TimeoutMs > 0 {
+		timeout = time.Duration(o.TimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(app.Ctx, timeout)
+	defer cancel()
+
+	if len(addrs) > 0 {
+		app.P2p.Host.Peerstore().AddAddrs(peerID, addrs, msDuration(o.AddrTTLMs, peerstore.TempAddrTTL))
+		if err := app.P2p.Host.Connect(ctx, peer.AddrInfo{ID: peerID, Addrs: addrs}); err != nil {
+			return nil, badp2p(err)
+		}
+	}
+
+	s, err := app.P2p.Host.NewStream(ctx, peerID, pids...)
 
 	if err != nil {
 		return nil, badp2p(err)
 	}
 
-	app.Streams[streamIdx] = stream
+	stream := newStream(s, streamIdx, app.streamOpts(o.MaxFrameSize, o.IdleTimeoutMs))
+	app.addStream(stream)
 	go func() {
 		// FIXME HACK: allow time for the openStreamResult to get printed before we start inserting stream events
 		time.Sleep(250 * time.Millisecond)
-		handleStreamReads(app, stream, streamIdx)
+		handleStreamReads(app, stream)
 	}()
-	return openStreamResult{StreamIdx: streamIdx, RemoteAddr: stream.Conn().RemoteMultiaddr().String(), RemotePeerID: stream.Conn().RemotePeer().String()}, nil
+	return openStreamResult{StreamIdx: streamIdx, RemoteAddr: stream.Conn().RemoteMultiaddr().String(), RemotePeerID: stream.Conn().RemotePeer().String(), Protocol: string(s.Protocol())}, nil
 }
 
 type closeStreamMsg struct {
 	StreamIdx int `json:"stream_idx"`
 }
 
+// closeStream closes both directions of the stream: we stop writing, and
+// stop delivering anything the remote sends.
 func (cs *closeStreamMsg) run(app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
-	if stream, ok := app.Streams[cs.StreamIdx]; ok {
-		err := stream.Close()
+	if stream, ok := app.getStream(cs.StreamIdx); ok {
+		stream.closeRead()
+		err := stream.closeWrite()
+		app.removeIfClosed(stream)
 		if err != nil {
 			return nil, badp2p(err)
 		}
@@ -497,6 +903,44 @@ func (cs *closeStreamMsg) run(app *app) (interface{}, error) {
 	return nil, badRPC(errors.New("unknown stream_idx"))
 }
 
+type closeStreamWriteMsg struct {
+	StreamIdx int `json:"stream_idx"`
+}
+
+// closeStreamWrite signals EOF to the remote, while we keep receiving
+// whatever it sends until it closes its end too.
+func (cs *closeStreamWriteMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	if stream, ok := app.getStream(cs.StreamIdx); ok {
+		err := stream.closeWrite()
+		app.removeIfClosed(stream)
+		if err != nil {
+			return nil, badp2p(err)
+		}
+		return "closeStreamWrite success", nil
+	}
+	return nil, badRPC(errors.New("unknown stream_idx"))
+}
+
+type closeStreamReadMsg struct {
+	StreamIdx int `json:"stream_idx"`
+}
+
+// closeStreamRead stops incomingStreamMsg upcalls for the stream, while we
+// can still write to it.
+func (cs *closeStreamReadMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	if stream, ok := app.getStream(cs.StreamIdx); ok {
+		stream.closeRead()
+		return "closeStreamRead success", nil
+	}
+	return nil, badRPC(errors.New("unknown stream_idx"))
+}
+
 type resetStreamMsg struct {
 	StreamIdx int `json:"stream_idx"`
 }
@@ -505,9 +949,10 @@ func (cs *resetStreamMsg) run(app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
-	if stream, ok := app.Streams[cs.StreamIdx]; ok {
-		err := stream.Reset()
-		if err != nil {
+	if stream, ok := app.getStream(cs.StreamIdx); ok {
+		// removed first, so the reset isn't reported back as lost
+		app.removeStream(stream)
+		if err := stream.abort("reset by resetStream"); err != nil {
 			return nil, badp2p(err)
 		}
 		return "resetStream success", nil
@@ -518,6 +963,8 @@ func (cs *resetStreamMsg) run(app *app) (interface{}, error) {
 type sendStreamMsgMsg struct {
 	StreamIdx int    `json:"stream_idx"`
 	Data      string `json:"data"`
+	// deadline for the write, zero for defaultWriteTimeout
+	TimeoutMs int `json:"timeout_ms"`
 }
 
 func (cs *sendStreamMsgMsg) run(app *app) (interface{}, error) {
@@ -529,9 +976,21 @@ func (cs *sendStreamMsgMsg) run(app *app) (interface{}, error) {
 		return nil, badRPC(err)
 	}
 
-	if stream, ok := app.Streams[cs.StreamIdx]; ok {
-		_, err := stream.Write(data)
+	if stream, ok := app.getStream(cs.StreamIdx); ok {
+		if stream.isWriteClosed() {
+			return nil, badRPC(errors.New("stream closed for writing"))
+		}
+		timeout := defaultWriteTimeout
+		if cs.TimeoutMs > 0 {
+			timeout = time.Duration(cs.TimeoutMs) * time.Millisecond
+		}
+		err := stream.writeMsgTimeout(data, timeout)
+		if _, ok := err.(frameTooLarge); ok {
+			return nil, badRPC(err)
+		}
 		if err != nil {
+			// we can't tell how much was sent, so the stream is done with
+			stream.abort(fmt.Sprintf("write failure: %v", err))
 			return nil, badp2p(err)
 		}
 		return "sendStreamMsg success", nil
@@ -539,8 +998,81 @@ func (cs *sendStreamMsgMsg) run(app *app) (interface{}, error) {
 	return nil, badRPC(errors.New("unknown stream_idx"))
 }
 
+type grantStreamCreditMsg struct {
+	StreamIdx int `json:"stream_idx"`
+	Bytes     int `json:"bytes"`
+}
+
+func (g *grantStreamCreditMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	if g.Bytes <= 0 {
+		return nil, badRPC(errors.New("credit must be positive"))
+	}
+	if stream, ok := app.getStream(g.StreamIdx); ok {
+		if stream.Credit == nil {
+			return nil, badRPC(errors.New("stream is not flow controlled"))
+		}
+		stream.Credit.grant(g.Bytes)
+		return "grantStreamCredit success", nil
+	}
+	return nil, badRPC(errors.New("unknown stream_idx"))
+}
+
+type listStreamsMsg struct {
+}
+
+type streamInfo struct {
+	StreamIdx int    `json:"stream_idx"`
+	PeerID    string `json:"peer_id"`
+	Protocol  string `json:"protocol"`
+	Direction string `json:"direction"`
+	AgeMs     int64  `json:"age_ms"`
+	BytesIn   uint64 `json:"bytes_in"`
+	BytesOut  uint64 `json:"bytes_out"`
+}
+
+func (ls *listStreamsMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	streams := app.listStreams()
+	infos := make([]streamInfo, len(streams))
+	for i, s := range streams {
+		in, out := s.counts()
+		infos[i] = streamInfo{
+			StreamIdx: s.Idx,
+			PeerID:    peer.IDB58Encode(s.Conn().RemotePeer()),
+			Protocol:  string(s.Protocol()),
+			Direction: directionString(s.Stat().Direction),
+			AgeMs:     int64(time.Since(s.Opened) / time.Millisecond),
+			BytesIn:   in,
+			BytesOut:  out,
+		}
+	}
+	return infos, nil
+}
+
 type addStreamHandlerMsg struct {
 	Protocol string `json:"protocol"`
+	// non-zero to frame messages on incoming streams, see stream.MaxFrame
+	MaxFrameSize  int `json:"max_frame_size"`
+	IdleTimeoutMs int `json:"idle_timeout_ms"`
+	// Requests makes this a request/response handler: instead of an
+	// incomingStream upcall, each stream yields one incomingRequest upcall
+	// (limited to MaxFrameSize) which is answered with respond.
+	Requests         bool `json:"requests"`
+	RequestTimeoutMs int  `json:"request_timeout_ms"`
+	// Limits on concurrent inbound streams, zero for no limit. Streams
+	// beyond the limits are reset straight away.
+	MaxStreams        int `json:"max_streams"`
+	MaxStreamsPerPeer int `json:"max_streams_per_peer"`
+	// Match widens the protocols handled beyond Protocol itself:
+	// "semver" handles any version of it with the same major version and
+	// an equal or lower minor version, "prefix" handles any protocol that
+	// starts with Protocol.
+	Match string `json:"match"`
 }
 
 type incomingStreamUpcall struct {
@@ -555,22 +1087,84 @@ func (as *addStreamHandlerMsg) run(app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
-	app.P2p.Host.SetStreamHandler(protocol.ID(as.Protocol), func(stream net.Stream) {
+	setHandler, err := app.streamHandlerSetter(protocol.ID(as.Protocol), as.Match)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	limits := newStreamLimits(as.MaxStreams, as.MaxStreamsPerPeer)
+	app.StreamsLock.Lock()
+	app.StreamLimits[as.Protocol] = limits
+	app.StreamsLock.Unlock()
+
+	// accept takes a slot for s, or resets it if there is none
+	accept := func(s net.Stream) (func(), bool) {
+		remote := s.Conn().RemotePeer()
+		if !limits.acquire(remote) {
+			app.P2p.Logger.Warningf("refusing %s stream from %s: too many streams (%d refused)", as.Protocol, remote.Pretty(), limits.refusals())
+			s.Reset()
+			return nil, false
+		}
+		var once sync.Once
+		return func() { once.Do(func() { limits.release(remote) }) }, true
+	}
+
+	if as.Requests {
+		maxSize := as.MaxFrameSize
+		if maxSize <= 0 {
+			maxSize = defaultMaxRequestSize
+		}
+		timeout := msDuration(as.RequestTimeoutMs, defaultRequestTimeout)
+		setHandler(func(s net.Stream) {
+			if release, ok := accept(s); ok {
+				handleRequest(app, s, maxSize, timeout, release)
+			}
+		})
+		return "addStreamHandler success", nil
+	}
+
+	setHandler(func(s net.Stream) {
+		release, ok := accept(s)
+		if !ok {
+			return
+		}
 		streamIdx := <-seqs
-		app.Streams[streamIdx] = stream
+		stream := newStream(s, streamIdx, app.streamOpts(as.MaxFrameSize, as.IdleTimeoutMs))
+		stream.onRemove = release
+		app.addStream(stream)
 		app.writeMsg(incomingStreamUpcall{
 			Upcall:       "incomingStream",
 			RemoteAddr:   stream.Conn().RemoteMultiaddr().String(),
 			RemotePeerID: stream.Conn().RemotePeer().String(),
 			StreamIdx:    streamIdx,
-			Protocol:     as.Protocol,
+			Protocol:     string(s.Protocol()),
 		})
-		handleStreamReads(app, stream, streamIdx)
+		handleStreamReads(app, stream)
 	})
 
 	return "addStreamHandler success", nil
 }
 
+// streamHandlerSetter returns a function registering a handler for pid,
+// matched as addStreamHandlerMsg.Match describes.
+func (app *app) streamHandlerSetter(pid protocol.ID, match string) (func(net.StreamHandler), error) {
+	var matches func(string) bool
+	switch match {
+	case "":
+		return func(h net.StreamHandler) { app.P2p.Host.SetStreamHandler(pid, h) }, nil
+	case "semver":
+		var err error
+		matches, err = helpers.MultistreamSemverMatcher(pid)
+		if err != nil {
+			return nil, errors.Errorf("protocol %s doesn't end in a semantic version: %v", pid, err)
+		}
+	case "prefix":
+		matches = func(p string) bool { return strings.HasPrefix(p, string(pid)) }
+	default:
+		return nil, errors.Errorf("unknown match %q, expected \"semver\" or \"prefix\"", match)
+	}
+	return func(h net.StreamHandler) { app.P2p.Host.SetStreamHandlerMatch(pid, matches, h) }, nil
+}
+
 type removeStreamHandlerMsg struct {
 	Protocol string `json:"protocol"`
 }
@@ -580,12 +1174,17 @@ func (rs *removeStreamHandlerMsg) run(app *app) (interface{}, error) {
 		return nil, needsConfigure()
 	}
 	app.P2p.Host.RemoveStreamHandler(protocol.ID(rs.Protocol))
+	app.StreamsLock.Lock()
+	delete(app.StreamLimits, rs.Protocol)
+	app.StreamsLock.Unlock()
 
 	return "removeStreamHandler success", nil
 }
 
 type addPeerMsg struct {
 	Multiaddr string `json:"multiaddr"`
+	// Seed peers are never pruned by the connection manager.
+	Seed bool `json:"seed"`
 }
 
 func (ap *addPeerMsg) run(app *app) (interface{}, error) {
@@ -607,6 +1206,13 @@ func (ap *addPeerMsg) run(app *app) (interface{}, error) {
 		return nil, badRPC(err)
 	}
 
+	if err := app.dialAllowed(info.ID, info.Addrs...); err != nil {
+		return nil, badp2p(err)
+	}
+	if ap.Seed {
+		app.P2p.Host.ConnManager().Protect(info.ID, seedTag)
+	}
+
 	// discovery should notice the connection event and do the dht thing
 	err = app.P2p.Host.Connect(app.Ctx, *info)
 
@@ -653,7 +1259,7 @@ func (ap *beginAdvertisingMsg) run(app *app) (interface{}, error) {
 	app.P2p.DiscoveredPeers = discovered
 
 	foundPeer := func(info peer.AddrInfo, source string) {
-		if info.ID != "" && len(info.Addrs) != 0 {
+		if info.ID != "" && len(info.Addrs) != 0 && app.dialAllowed(info.ID, info.Addrs...) == nil {
 			ctx, cancel := context.WithTimeout(app.Ctx, 15*time.Second)
 			defer cancel()
 			if err := app.P2p.Host.Connect(ctx, info); err != nil {
@@ -724,6 +1330,25 @@ var msgHandlers = map[methodIdx]func() action{
 	listeningAddrs:      func() action { return &listeningAddrsMsg{} },
 	addPeer:             func() action { return &addPeerMsg{} },
 	beginAdvertising:    func() action { return &beginAdvertisingMsg{} },
+	grantStreamCredit:   func() action { return &grantStreamCreditMsg{} },
+	closeStreamWrite:    func() action { return &closeStreamWriteMsg{} },
+	closeStreamRead:     func() action { return &closeStreamReadMsg{} },
+	listStreams:         func() action { return &listStreamsMsg{} },
+	request:             func() action { return &requestMsg{} },
+	respond:             func() action { return &respondMsg{} },
+	streamStats:         func() action { return &streamStatsMsg{} },
+	banPeer:             func() action { return &banPeerMsg{} },
+	unbanPeer:           func() action { return &unbanPeerMsg{} },
+	listBans:            func() action { return &listBansMsg{} },
+	setAllowlist:        func() action { return &setAllowlistMsg{} },
+	getAllowlist:        func() action { return &getAllowlistMsg{} },
+	listPeers:           func() action { return &listPeersMsg{} },
+	disconnectPeer:      func() action { return &disconnectPeerMsg{} },
+	closeConnection:     func() action { return &closeConnectionMsg{} },
+	ping:                func() action { return &pingMsg{} },
+	persistentPeers:     func() action { return &persistentPeersMsg{} },
+	peerScores:          func() action { return &peerScoresMsg{} },
+	bandwidthStats:      func() action { return &bandwidthStatsMsg{} },
 }
 
 type errorResult struct {
@@ -736,6 +1361,19 @@ type successResult struct {
 	Success json.RawMessage `json:"success"`
 }
 
+func (app *app) writeResult(seqno int, res interface{}, err error) {
+	if err == nil {
+		res, err := json.Marshal(res)
+		if err == nil {
+			app.writeMsg(successResult{Seqno: seqno, Success: res})
+		} else {
+			app.writeMsg(errorResult{Seqno: seqno, Errorr: err.Error()})
+		}
+	} else {
+		app.writeMsg(errorResult{Seqno: seqno, Errorr: err.Error()})
+	}
+}
+
 func main() {
 	logwriter.Configure(logwriter.Output(os.Stderr), logwriter.LdJSONFormatter)
 	log.SetOutput(os.Stderr)
@@ -751,14 +1389,23 @@ func main() {
 	}()
 
 	lines := bufio.NewScanner(os.Stdin)
+	// publish and stream RPCs carry base58 payloads well over the default
+	// 64KiB line limit, chunked pubsub messages up to max_chunked_msg_size
+	lines.Buffer(make([]byte, 64<<10), maxRPCLineSize)
 	out := bufio.NewWriter(os.Stdout)
 
 	app := &app{
-		P2p:        nil,
-		Ctx:        context.Background(),
-		Subs:       make(map[int]subscription),
-		Validators: make(map[int]chan bool),
-		Streams:    make(map[int]net.Stream),
+		P2p:          nil,
+		Ctx:          context.Background(),
+		Subs:         make(map[int]subscription),
+		Validators:   make(map[int]chan bool),
+		Streams:      make(map[int]*stream),
+		Requests:     newPendingRequests(),
+		StreamLimits: make(map[string]*streamLimits),
+		Traffic:      newTrafficStats(),
+		Allowlist:    &allowlist{},
+		Conns:        newConnTracker(),
+		Backoff:      newDialBackoff(),
 		// OutLock doesn't need to be initialized
 		Out: out,
 		// RpcLock doesn't need to be initialized
@@ -784,17 +1431,26 @@ func main() {
 				helperLog.Error("While handling RPC:", line, "\nThe following panic occurred: ", r)
 			}
 		}()
-		res, err := msg.run(app)
-		if err == nil {
-			res, err := json.Marshal(res)
-			if err == nil {
-				app.writeMsg(successResult{Seqno: env.Seqno, Success: res})
-			} else {
-				app.writeMsg(errorResult{Seqno: env.Seqno, Errorr: err.Error()})
-			}
-		} else {
-			app.writeMsg(errorResult{Seqno: env.Seqno, Errorr: err.Error()})
+		if _, ok := msg.(asyncAction); ok {
+			seqno := env.Seqno
+			go func() {
+				// the recover in main doesn't cover this goroutine
+				defer func() {
+					if r := recover(); r != nil {
+						helperLog.Error("While handling RPC:", line, "\nThe following panic occurred: ", r)
+						app.writeResult(seqno, nil, badHelper(errors.Errorf("panic: %v", r)))
+					}
+				}()
+				res, err := msg.run(app)
+				app.writeResult(seqno, res, err)
+			}()
+			continue
 		}
+		res, err := msg.run(app)
+		app.writeResult(env.Seqno, res, err)
+	}
+	if app.P2p != nil {
+		app.P2p.Tracer.Close()
 	}
 	os.Exit(0)
 }
@@ -25,6 +25,25 @@ var (
 		"listeningAddrs":      listeningAddrs,
 		"addPeer":             addPeer,
 		"beginAdvertising":    beginAdvertising,
+		"grantStreamCredit":   grantStreamCredit,
+		"closeStreamWrite":    closeStreamWrite,
+		"closeStreamRead":     closeStreamRead,
+		"listStreams":         listStreams,
+		"request":             request,
+		"respond":             respond,
+		"streamStats":         streamStats,
+		"banPeer":             banPeer,
+		"unbanPeer":           unbanPeer,
+		"listBans":            listBans,
+		"setAllowlist":        setAllowlist,
+		"getAllowlist":        getAllowlist,
+		"listPeers":           listPeers,
+		"disconnectPeer":      disconnectPeer,
+		"closeConnection":     closeConnection,
+		"ping":                ping,
+		"persistentPeers":     persistentPeers,
+		"peerScores":          peerScores,
+		"bandwidthStats":      bandwidthStats,
 	}
 
 	_methodIdxValueToName = map[methodIdx]string{
@@ -44,6 +63,25 @@ var (
 		listeningAddrs:      "listeningAddrs",
 		addPeer:             "addPeer",
 		beginAdvertising:    "beginAdvertising",
+		grantStreamCredit:   "grantStreamCredit",
+		closeStreamWrite:    "closeStreamWrite",
+		closeStreamRead:     "closeStreamRead",
+		listStreams:         "listStreams",
+		request:             "request",
+		respond:             "respond",
+		streamStats:         "streamStats",
+		banPeer:             "banPeer",
+		unbanPeer:           "unbanPeer",
+		listBans:            "listBans",
+		setAllowlist:        "setAllowlist",
+		getAllowlist:        "getAllowlist",
+		listPeers:           "listPeers",
+		disconnectPeer:      "disconnectPeer",
+		closeConnection:     "closeConnection",
+		ping:                "ping",
+		persistentPeers:     "persistentPeers",
+		peerScores:          "peerScores",
+		bandwidthStats:      "bandwidthStats",
 	}
 )
 
@@ -67,6 +105,25 @@ func init() {
 			interface{}(listeningAddrs).(fmt.Stringer).String():      listeningAddrs,
 			interface{}(addPeer).(fmt.Stringer).String():             addPeer,
 			interface{}(beginAdvertising).(fmt.Stringer).String():    beginAdvertising,
+			interface{}(grantStreamCredit).(fmt.Stringer).String():   grantStreamCredit,
+			interface{}(closeStreamWrite).(fmt.Stringer).String():    closeStreamWrite,
+			interface{}(closeStreamRead).(fmt.Stringer).String():     closeStreamRead,
+			interface{}(listStreams).(fmt.Stringer).String():         listStreams,
+			interface{}(request).(fmt.Stringer).String():             request,
+			interface{}(respond).(fmt.Stringer).String():             respond,
+			interface{}(streamStats).(fmt.Stringer).String():         streamStats,
+			interface{}(banPeer).(fmt.Stringer).String():             banPeer,
+			interface{}(unbanPeer).(fmt.Stringer).String():           unbanPeer,
+			interface{}(listBans).(fmt.Stringer).String():            listBans,
+			interface{}(setAllowlist).(fmt.Stringer).String():        setAllowlist,
+			interface{}(getAllowlist).(fmt.Stringer).String():        getAllowlist,
+			interface{}(listPeers).(fmt.Stringer).String():           listPeers,
+			interface{}(disconnectPeer).(fmt.Stringer).String():      disconnectPeer,
+			interface{}(closeConnection).(fmt.Stringer).String():     closeConnection,
+			interface{}(ping).(fmt.Stringer).String():                ping,
+			interface{}(persistentPeers).(fmt.Stringer).String():     persistentPeers,
+			interface{}(peerScores).(fmt.Stringer).String():          peerScores,
+			interface{}(bandwidthStats).(fmt.Stringer).String():      bandwidthStats,
 		}
 	}
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	net "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// trackedConn is what the helper knows about a connection beyond libp2p.
+type trackedConn struct {
+	// ID identifies the connection in RPCs, libp2p has no IDs for them.
+	ID     int
+	Opened time.Time
+	// Reported is set once the coda process has been told about the
+	// connection, connections closed by the helper straight away aren't.
+	Reported bool
+}
+
+// connTracker numbers connections and remembers when they were opened, and
+// counts the reported connections to each peer.
+type connTracker struct {
+	lock     sync.Mutex
+	conns    map[net.Conn]trackedConn
+	reported map[peer.ID]int
+	nextID   int
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]trackedConn), reported: make(map[peer.ID]int)}
+}
+
+// add starts tracking c if it is new, returning its details. Only the
+// connection notifiee adds connections, so that closed ones aren't tracked
+// again after remove.
+func (t *connTracker) add(c net.Conn) trackedConn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tc, ok := t.conns[c]
+	if !ok {
+		tc = trackedConn{ID: t.nextID, Opened: time.Now()}
+		t.nextID++
+		t.conns[c] = tc
+	}
+	return tc
+}
+
+// lookup returns c's details if it is tracked.
+func (t *connTracker) lookup(c net.Conn) (trackedConn, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tc, ok := t.conns[c]
+	return tc, ok
+}
+
+// report marks c as reported, returning true if it is the first reported
+// connection to its peer.
+func (t *connTracker) report(c net.Conn) (trackedConn, bool) {
+	tc := t.add(c)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tc.Reported = true
+	t.conns[c] = tc
+	p := c.RemotePeer()
+	t.reported[p]++
+	return tc, t.reported[p] == 1
+}
+
+// remove stops tracking c, returning true if it was the last reported
+// connection to its peer.
+func (t *connTracker) remove(c net.Conn) (trackedConn, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tc, ok := t.conns[c]
+	delete(t.conns, c)
+	if !ok || !tc.Reported {
+		return tc, false
+	}
+	p := c.RemotePeer()
+	t.reported[p]--
+	if t.reported[p] > 0 {
+		return tc, false
+	}
+	delete(t.reported, p)
+	return tc, true
+}
+
+// find returns the connection with the given ID.
+func (t *connTracker) find(id int) (net.Conn, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for c, tc := range t.conns {
+		if tc.ID == id {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+type peerConnectionUpcall struct {
+	Upcall     string `json:"upcall"`
+	PeerID     string `json:"peer_id"`
+	ConnID     int    `json:"conn_id"`
+	RemoteAddr string `json:"remote_addr"`
+	Direction  string `json:"direction"`
+}
+
+func newPeerConnectionUpcall(upcall string, c net.Conn, tc trackedConn) peerConnectionUpcall {
+	return peerConnectionUpcall{
+		Upcall:     upcall,
+		PeerID:     peer.IDB58Encode(c.RemotePeer()),
+		ConnID:     tc.ID,
+		RemoteAddr: c.RemoteMultiaddr().String(),
+		Direction:  directionString(c.Stat().Direction),
+	}
+}
+
+// connNotifiee tracks connections, and sends peerConnected when we first
+// connect to a peer and peerDisconnected when its last connection closes.
+// Connections the helper refuses (see gateNotifiee) aren't reported.
+func connNotifiee(app *app) net.Notifiee {
+	return &net.NotifyBundle{
+		ConnectedF: func(_ net.Network, c net.Conn) {
+			if app.connAllowed(c) != nil {
+				app.Conns.add(c)
+				return
+			}
+			if tc, first := app.Conns.report(c); first {
+				app.writeMsg(newPeerConnectionUpcall("peerConnected", c, tc))
+			}
+		},
+		DisconnectedF: func(_ net.Network, c net.Conn) {
+			go app.abortConnStreams(c)
+			if tc, last := app.Conns.remove(c); last {
+				app.writeMsg(newPeerConnectionUpcall("peerDisconnected", c, tc))
+				app.Persistent.notifyDisconnected(c.RemotePeer())
+			}
+		},
+	}
+}
+
+type listPeersMsg struct{}
+
+type connInfo struct {
+	ConnID     int    `json:"conn_id"`
+	RemoteAddr string `json:"remote_addr"`
+	Direction  string `json:"direction"`
+	AgeMs      int64  `json:"age_ms"`
+}
+
+type peerInfo struct {
+	PeerID      string     `json:"peer_id"`
+	Connections []connInfo `json:"connections"`
+	// Protocols and AgentVersion are learned from identify, so they are
+	// empty until it completes.
+	Protocols    []string `json:"protocols"`
+	AgentVersion string   `json:"agent_version"`
+	// LatencyMs is a moving average of round trip times, from pings by
+	// the ping method and the helper's periodic probes, zero if unknown.
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+func (lp *listPeersMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	network := app.P2p.Host.Network()
+	ps := app.P2p.Host.Peerstore()
+
+	peers := network.Peers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	infos := make([]peerInfo, 0, len(peers))
+	for _, p := range peers {
+		info := peerInfo{PeerID: peer.IDB58Encode(p), Connections: []connInfo{}}
+		for _, c := range network.ConnsToPeer(p) {
+			tc, ok := app.Conns.lookup(c)
+			if !ok {
+				// closed, or its notification hasn't arrived yet
+				continue
+			}
+			info.Connections = append(info.Connections, connInfo{
+				ConnID:     tc.ID,
+				RemoteAddr: c.RemoteMultiaddr().String(),
+				Direction:  directionString(c.Stat().Direction),
+				AgeMs:      int64(time.Since(tc.Opened) / time.Millisecond),
+			})
+		}
+		if len(info.Connections) == 0 {
+			continue
+		}
+		sort.Slice(info.Connections, func(i, j int) bool { return info.Connections[i].ConnID < info.Connections[j].ConnID })
+
+		info.Protocols, _ = ps.GetProtocols(p)
+		if info.Protocols == nil {
+			info.Protocols = []string{}
+		}
+		sort.Strings(info.Protocols)
+		if agent, err := ps.Get(p, "AgentVersion"); err == nil {
+			info.AgentVersion, _ = agent.(string)
+		}
+		info.LatencyMs = durationMs(ps.LatencyEWMA(p))
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+type disconnectPeerMsg struct {
+	Peer string `json:"peer"`
+	// non-zero to stop the helper dialing the peer again, or keeping its
+	// connections, for this long
+	BackoffMs int `json:"backoff_ms"`
+}
+
+func (d *disconnectPeerMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	id, err := peer.IDB58Decode(d.Peer)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	if d.BackoffMs > 0 {
+		app.Backoff.add(id, time.Duration(d.BackoffMs)*time.Millisecond)
+	}
+	if err := app.P2p.Host.Network().ClosePeer(id); err != nil {
+		return nil, badp2p(err)
+	}
+	return "disconnectPeer success", nil
+}
+
+type closeConnectionMsg struct {
+	ConnID int `json:"conn_id"`
+}
+
+// closeConnection closes one connection to a peer, as listed by listPeers,
+// leaving any others open.
+func (cc *closeConnectionMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	c, ok := app.Conns.find(cc.ConnID)
+	if !ok {
+		return nil, badRPC(errors.New("unknown conn_id"))
+	}
+	if err := c.Close(); err != nil {
+		return nil, badp2p(err)
+	}
+	return "closeConnection success", nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	net "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Persistent peers are redialed after this long, doubling after each failure
+// or dropped connection up to the maximum. The backoff only starts over once
+// a connection has lasted persistentStableAfter, so peers that accept our
+// connections and then drop them aren't redialed in a tight loop.
+const (
+	persistentMinBackoff  = time.Second
+	persistentMaxBackoff  = 5 * time.Minute
+	persistentDialTimeout = 30 * time.Second
+	persistentStableAfter = time.Minute
+)
+
+// persistent peers are protected from the connection manager with this tag
+const persistentTag = "persistent"
+
+// persistentPeer is a peer the helper keeps connected to.
+type persistentPeer struct {
+	Info peer.AddrInfo
+	// disconnected wakes the redialer when the last connection closes
+	disconnected chan struct{}
+
+	lock      sync.Mutex
+	connected bool
+	since     time.Time
+	failures  int
+	lastError string
+	nextDial  time.Time
+}
+
+type persistentList struct {
+	peers map[peer.ID]*persistentPeer
+}
+
+// parsePersistentPeers parses multiaddrs ending in /p2p/<peer ID>.
+func parsePersistentPeers(addrs []string) (*persistentList, error) {
+	pp := &persistentList{peers: make(map[peer.ID]*persistentPeer)}
+	for _, a := range addrs {
+		maddr, err := multiaddr.NewMultiaddr(a)
+		if err != nil {
+			return nil, err
+		}
+		info, err := peer.AddrInfoFromP2pAddr(maddr)
+		if err != nil {
+			return nil, errors.Errorf("persistent peer %s: %v", a, err)
+		}
+		if p, ok := pp.peers[info.ID]; ok {
+			p.Info.Addrs = append(p.Info.Addrs, info.Addrs...)
+			continue
+		}
+		pp.peers[info.ID] = &persistentPeer{Info: *info, disconnected: make(chan struct{}, 1)}
+	}
+	return pp, nil
+}
+
+// notifyDisconnected tells p's redialer that we lost our last connection to
+// it.
+func (pp *persistentList) notifyDisconnected(p peer.ID) {
+	if pp == nil {
+		return
+	}
+	if peer, ok := pp.peers[p]; ok {
+		select {
+		case peer.disconnected <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// start protects the peers from the connection manager and keeps them
+// connected until ctx is done.
+func (pp *persistentList) start(ctx context.Context, app *app) {
+	for id, p := range pp.peers {
+		app.P2p.Host.Peerstore().AddAddrs(id, p.Info.Addrs, peerstore.PermanentAddrTTL)
+		app.P2p.Host.ConnManager().Protect(id, persistentTag)
+		go p.keepConnected(ctx, app)
+	}
+}
+
+func (p *persistentPeer) keepConnected(ctx context.Context, app *app) {
+	backoff := persistentMinBackoff
+	for {
+		if app.P2p.Host.Network().Connectedness(p.Info.ID) != net.Connected {
+			err := app.dialAllowed(p.Info.ID)
+			if err == nil {
+				dialCtx, cancel := context.WithTimeout(ctx, persistentDialTimeout)
+				err = app.P2p.Host.Connect(dialCtx, p.Info)
+				cancel()
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				app.P2p.Logger.Warningf("failed to connect to persistent peer %s, retrying in %v: %v", p.Info.ID.Pretty(), backoff, err)
+				p.failed(err, backoff)
+				if !sleep(ctx, backoff) {
+					return
+				}
+				backoff = nextBackoff(backoff)
+				continue
+			}
+		}
+
+		p.setConnected(true)
+		connectedAt := time.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.disconnected:
+		}
+		if time.Since(connectedAt) >= persistentStableAfter {
+			backoff = persistentMinBackoff
+		}
+		app.P2p.Logger.Infof("lost connection to persistent peer %s, redialing in %v", p.Info.ID.Pretty(), backoff)
+		p.lost(backoff)
+		if !sleep(ctx, backoff) {
+			return
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > persistentMaxBackoff {
+		backoff = persistentMaxBackoff
+	}
+	return backoff
+}
+
+func (p *persistentPeer) failed(err error, backoff time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.connected = false
+	p.failures++
+	p.lastError = err.Error()
+	p.nextDial = time.Now().Add(backoff)
+}
+
+func (p *persistentPeer) setConnected(connected bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if connected && !p.connected {
+		p.since = time.Now()
+		p.failures = 0
+		p.lastError = ""
+		p.nextDial = time.Time{}
+	}
+	p.connected = connected
+}
+
+// lost records that the connection dropped and we will redial after backoff.
+func (p *persistentPeer) lost(backoff time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.connected = false
+	p.nextDial = time.Now().Add(backoff)
+}
+
+type persistentPeerStatus struct {
+	PeerID    string   `json:"peer_id"`
+	Addrs     []string `json:"multiaddrs"`
+	Connected bool     `json:"connected"`
+	// how long we have been connected, or if not, when the next dial is
+	ConnectedMs  int64 `json:"connected_ms,omitempty"`
+	NextDialInMs int64 `json:"next_dial_in_ms,omitempty"`
+	// failed dials since we were last connected
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+func (p *persistentPeer) status() persistentPeerStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s := persistentPeerStatus{
+		PeerID:    peer.IDB58Encode(p.Info.ID),
+		Addrs:     make([]string, len(p.Info.Addrs)),
+		Connected: p.connected,
+		Failures:  p.failures,
+		LastError: p.lastError,
+	}
+	for i, a := range p.Info.Addrs {
+		s.Addrs[i] = a.String()
+	}
+	if p.connected {
+		s.ConnectedMs = int64(time.Since(p.since) / time.Millisecond)
+	} else if !p.nextDial.IsZero() {
+		s.NextDialInMs = int64(time.Until(p.nextDial) / time.Millisecond)
+	}
+	return s
+}
+
+type persistentPeersMsg struct{}
+
+func (pm *persistentPeersMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	statuses := make([]persistentPeerStatus, 0, len(app.Persistent.peers))
+	for _, p := range app.Persistent.peers {
+		statuses = append(statuses, p.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].PeerID < statuses[j].PeerID })
+	return statuses, nil
+}
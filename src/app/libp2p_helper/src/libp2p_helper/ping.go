@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-errors/errors"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	p2pping "github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+const (
+	defaultPingCount   = 3
+	maxPingCount       = 100
+	defaultPingTimeout = 10 * time.Second
+	// connected peers are pinged this often to keep their latency averages
+	// (peerstore.LatencyEWMA) current
+	latencyProbeInterval = time.Minute
+)
+
+type pingMsg struct {
+	Peer string `json:"peer"`
+	// Count is the number of round trips, defaultPingCount if zero.
+	Count int `json:"count"`
+	// deadline for all the round trips, defaultPingTimeout if zero
+	TimeoutMs int `json:"timeout_ms"`
+}
+
+type pingResult struct {
+	SamplesMs []float64 `json:"samples_ms"`
+	// LatencyMs is the peer's moving average round trip time, including
+	// these samples.
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+func (p *pingMsg) async() {}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (p *pingMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	id, err := peer.IDB58Decode(p.Peer)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	if err := app.dialAllowed(id); err != nil {
+		return nil, badp2p(err)
+	}
+	count := p.Count
+	if count <= 0 {
+		count = defaultPingCount
+	}
+	if count > maxPingCount {
+		return nil, badRPC(errors.Errorf("count may be at most %d", maxPingCount))
+	}
+
+	ctx, cancel := context.WithTimeout(app.Ctx, msDuration(p.TimeoutMs, defaultPingTimeout))
+	defer cancel()
+	res := pingResult{SamplesMs: make([]float64, 0, count)}
+	for r := range p2pping.Ping(ctx, app.P2p.Host, id) {
+		if r.Error != nil {
+			return nil, badp2p(r.Error)
+		}
+		res.SamplesMs = append(res.SamplesMs, durationMs(r.RTT))
+		if len(res.SamplesMs) == count {
+			break
+		}
+	}
+	if len(res.SamplesMs) < count {
+		return nil, badp2p(errors.Errorf("timed out after %d of %d pings", len(res.SamplesMs), count))
+	}
+	res.LatencyMs = durationMs(app.P2p.Host.Peerstore().LatencyEWMA(id))
+	return res, nil
+}
+
+// probeLatency pings each connected peer every latencyProbeInterval, which
+// records the round trip time in the peerstore, until ctx is done.
+func (app *app) probeLatency(ctx context.Context) {
+	ticker := time.NewTicker(latencyProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, p := range app.P2p.Host.Network().Peers() {
+			go func(p peer.ID) {
+				ctx, cancel := context.WithTimeout(ctx, defaultPingTimeout)
+				defer cancel()
+				if r := <-p2pping.Ping(ctx, app.P2p.Host, p); r.Error != nil {
+					app.P2p.Logger.Debugf("latency probe of %s failed: %v", p.Pretty(), r.Error)
+				}
+			}(p)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// rateLimit configures a token bucket: Rate messages per second on average,
+// with bursts of up to Burst messages.
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+type bucket struct {
+	Limit  rateLimit
+	Tokens float64
+	Last   time.Time
+}
+
+// take refills the bucket for the time elapsed since it was last used, then
+// tries to remove cost tokens from it.
+func (b *bucket) take(now time.Time, cost float64) bool {
+	b.Tokens += now.Sub(b.Last).Seconds() * b.Limit.Rate
+	if b.Tokens > b.Limit.Burst {
+		b.Tokens = b.Limit.Burst
+	}
+	b.Last = now
+	if b.Tokens < cost {
+		return false
+	}
+	b.Tokens -= cost
+	return true
+}
+
+// reserve is take for callers that can wait: it always removes cost tokens,
+// going into debt if need be, and returns how long until the debt is repaid.
+func (b *bucket) reserve(now time.Time, cost float64) time.Duration {
+	b.take(now, 0)
+	b.Tokens -= cost
+	if b.Tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.Tokens / b.Limit.Rate * float64(time.Second))
+}
+
+type limiterKey struct {
+	Peer  peer.ID
+	Topic string
+}
+
+// gossipLimiter rate limits pubsub messages per (peer, topic) before they
+// reach the coda process for validation. Topics without a limit of their own
+// use Default; if that is nil too, they aren't limited.
+type gossipLimiter struct {
+	Default *rateLimit
+	// BanAfter is the number of violations after which a peer is
+	// blacklisted, zero to never blacklist.
+	BanAfter int
+
+	lock       sync.Mutex
+	topics     map[string]rateLimit
+	buckets    map[limiterKey]*bucket
+	violations map[peer.ID]int
+}
+
+func newGossipLimiter(def *rateLimit, banAfter int) *gossipLimiter {
+	return &gossipLimiter{
+		Default:    def,
+		BanAfter:   banAfter,
+		topics:     make(map[string]rateLimit),
+		buckets:    make(map[limiterKey]*bucket),
+		violations: make(map[peer.ID]int),
+	}
+}
+
+func (l *gossipLimiter) setTopicLimit(topic string, limit *rateLimit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if limit == nil {
+		delete(l.topics, topic)
+	} else {
+		l.topics[topic] = *limit
+	}
+	for key := range l.buckets {
+		if key.Topic == topic {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allow charges cost messages from p on topic. When the limit is exceeded it
+// returns false along with the number of violations p has accumulated.
+func (l *gossipLimiter) allow(p peer.ID, topic string, cost float64) (bool, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limit, ok := l.topics[topic]
+	if !ok {
+		if l.Default == nil {
+			return true, 0
+		}
+		limit = *l.Default
+	}
+
+	now := time.Now()
+	key := limiterKey{Peer: p, Topic: topic}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{Limit: limit, Tokens: limit.Burst, Last: now}
+		l.buckets[key] = b
+	}
+	if b.take(now, cost) {
+		return true, 0
+	}
+	l.violations[p]++
+	return false, l.violations[p]
+}
+
+// expire forgets buckets which have refilled completely, as they behave the
+// same as fresh ones.
+func (l *gossipLimiter) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.lock.Lock()
+			for key, b := range l.buckets {
+				if b.Limit.Rate <= 0 {
+					continue
+				}
+				full := time.Duration((b.Limit.Burst - b.Tokens) / b.Limit.Rate * float64(time.Second))
+				if now.Sub(b.Last) > full {
+					delete(l.buckets, key)
+				}
+			}
+			l.lock.Unlock()
+		}
+	}
+}
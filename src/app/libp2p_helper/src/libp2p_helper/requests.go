@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/libp2p/go-libp2p-core/helpers"
+	net "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	protocol "github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// A request/response exchange uses one stream per request: the requester
+// sends a single framed message and closes its end, the handler replies with
+// a single framed message and closes its end.
+const (
+	defaultMaxRequestSize = 16 << 20
+	defaultRequestTimeout = 30 * time.Second
+)
+
+type pendingRequest struct {
+	Stream  net.Stream
+	Timer   *time.Timer
+	Release func()
+	Opened  time.Time
+}
+
+// pendingRequests holds inbound requests waiting for the coda process to
+// respond, keyed by reply token.
+type pendingRequests struct {
+	lock     sync.Mutex
+	requests map[int]pendingRequest
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{requests: make(map[int]pendingRequest)}
+}
+
+// add registers a request which is reset if it isn't answered in time.
+// release is called once it is answered or reset, and onTimeout if it
+// isn't answered.
+func (p *pendingRequests) add(token int, s net.Stream, opened time.Time, timeout time.Duration, release func(), onTimeout func(pendingRequest)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.requests[token] = pendingRequest{
+		Stream:  s,
+		Release: release,
+		Opened:  opened,
+		Timer: time.AfterFunc(timeout, func() {
+			if req, ok := p.take(token); ok {
+				req.Stream.Reset()
+				onTimeout(req)
+			}
+		}),
+	}
+}
+
+func (p *pendingRequests) take(token int) (pendingRequest, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	req, ok := p.requests[token]
+	if !ok {
+		return pendingRequest{}, false
+	}
+	req.Timer.Stop()
+	req.Release()
+	delete(p.requests, token)
+	return req, true
+}
+
+func msDuration(ms int, def time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return def
+}
+
+// Requests and responses are base64 encoded like pubsub payloads (see
+// publishMsg), as they can be as large.
+type requestMsg struct {
+	Peer            string `json:"peer"`
+	ProtocolID      string `json:"protocol"`
+	Data            string `json:"data"`
+	TimeoutMs       int    `json:"timeout_ms"`
+	MaxResponseSize int    `json:"max_response_size"`
+}
+
+type requestResult struct {
+	Data string `json:"data"`
+}
+
+func (r *requestMsg) async() {}
+
+func (r *requestMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	peer, err := peer.IDB58Decode(r.Peer)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(r.Data)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	if err := app.dialAllowed(peer); err != nil {
+		return nil, badp2p(err)
+	}
+	maxSize := r.MaxResponseSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxRequestSize
+	}
+
+	// the timeout covers the whole exchange
+	deadline := time.Now().Add(msDuration(r.TimeoutMs, defaultRequestTimeout))
+	ctx, cancel := context.WithDeadline(app.Ctx, deadline)
+	defer cancel()
+
+	opened := time.Now()
+	s, err := app.P2p.Host.NewStream(ctx, peer, protocol.ID(r.ProtocolID))
+	if err != nil {
+		return nil, badp2p(err)
+	}
+	s = app.Bandwidth.throttle(s)
+	s.SetDeadline(deadline)
+
+	counts := trafficCounts{Streams: 1}
+	defer func() {
+		counts.OpenMs = int64(time.Since(opened) / time.Millisecond)
+		app.Traffic.record(string(s.Protocol()), s.Conn().RemotePeer().Pretty(), counts)
+	}()
+	fail := func(err error) (interface{}, error) {
+		counts.Errors++
+		s.Reset()
+		return nil, badp2p(err)
+	}
+
+	n, err := writeFrame(s, data)
+	if err != nil {
+		return fail(err)
+	}
+	counts.BytesOut, counts.MsgsOut = uint64(n), 1
+	if err := s.Close(); err != nil {
+		return fail(err)
+	}
+
+	resp, err := readFrame(bufio.NewReader(s), maxSize)
+	if err != nil {
+		return fail(err)
+	}
+	counts.BytesIn, counts.MsgsIn = uint64(len(resp)), 1
+	go helpers.AwaitEOF(s)
+
+	return requestResult{Data: base64.StdEncoding.EncodeToString(resp)}, nil
+}
+
+type incomingRequestUpcall struct {
+	Upcall       string `json:"upcall"`
+	RequestID    int    `json:"request_id"`
+	RemotePeerID string `json:"remote_peerid"`
+	Protocol     string `json:"protocol"`
+	Data         string `json:"data"`
+}
+
+// handleRequest reads a request from s, and passes it to the coda process
+// with a token to respond with. release is called when the request is
+// done with.
+func handleRequest(app *app, s net.Stream, maxSize int, timeout time.Duration, release func()) {
+	opened := time.Now()
+	s = app.Bandwidth.throttle(s)
+	record := func(counts trafficCounts) {
+		app.Traffic.record(string(s.Protocol()), s.Conn().RemotePeer().Pretty(), counts)
+	}
+
+	s.SetReadDeadline(time.Now().Add(timeout))
+	req, err := readFrame(bufio.NewReader(s), maxSize)
+	if err != nil {
+		app.P2p.Logger.Warningf("failed to read request from %s: %v", s.Conn().RemotePeer().Pretty(), err)
+		s.Reset()
+		release()
+		record(trafficCounts{Streams: 1, Errors: 1, OpenMs: int64(time.Since(opened) / time.Millisecond)})
+		return
+	}
+	s.SetReadDeadline(time.Time{})
+	record(trafficCounts{Streams: 1, BytesIn: uint64(len(req)), MsgsIn: 1})
+
+	token := <-seqs
+	app.Requests.add(token, s, opened, timeout, release, func(req pendingRequest) {
+		record(trafficCounts{Errors: 1, OpenMs: int64(time.Since(req.Opened) / time.Millisecond)})
+	})
+	app.writeMsg(incomingRequestUpcall{
+		Upcall:       "incomingRequest",
+		RequestID:    token,
+		RemotePeerID: s.Conn().RemotePeer().String(),
+		Protocol:     string(s.Protocol()),
+		Data:         base64.StdEncoding.EncodeToString(req),
+	})
+}
+
+type respondMsg struct {
+	RequestID int    `json:"request_id"`
+	Data      string `json:"data"`
+}
+
+// respond waits on the write to the requester, so it doesn't hold up other
+// RPCs.
+func (r *respondMsg) async() {}
+
+func (r *respondMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	data, err := base64.StdEncoding.DecodeString(r.Data)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	req, ok := app.Requests.take(r.RequestID)
+	if !ok {
+		return nil, badRPC(errors.New("unknown request_id, it may have timed out"))
+	}
+	s := req.Stream
+
+	var counts trafficCounts
+	defer func() {
+		counts.OpenMs = int64(time.Since(req.Opened) / time.Millisecond)
+		app.Traffic.record(string(s.Protocol()), s.Conn().RemotePeer().Pretty(), counts)
+	}()
+
+	s.SetWriteDeadline(time.Now().Add(defaultWriteTimeout))
+	n, err := writeFrame(s, data)
+	if err != nil {
+		counts.Errors++
+		s.Reset()
+		return nil, badp2p(err)
+	}
+	counts.BytesOut, counts.MsgsOut = uint64(n), 1
+	if err := s.Close(); err != nil {
+		counts.Errors++
+		return nil, badp2p(err)
+	}
+	return "respond success", nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// scoreParams configures peer scoring. Each event adds its weight to the
+// peer's score, which decays towards zero with the given half-life.
+type scoreParams struct {
+	// for each gossip message the peer forwarded that the coda process
+	// found valid or invalid
+	ValidMsg   float64 `json:"valid_msg"`
+	InvalidMsg float64 `json:"invalid_msg"`
+	// for each stream with the peer that was reset or failed
+	StreamError float64 `json:"stream_error"`
+	// for each message over the gossip rate limit
+	RateLimited float64 `json:"rate_limited"`
+	// for each minute the peer is connected
+	UptimeMinute float64 `json:"uptime_minute"`
+	HalfLifeMs   int     `json:"half_life_ms"`
+	// Peers are disconnected when their score falls to DisconnectBelow, and
+	// banned for BanDurationMs (or until unbanPeer if zero) at BanBelow.
+	// Zero disables either action.
+	DisconnectBelow float64 `json:"disconnect_below"`
+	BanBelow        float64 `json:"ban_below"`
+	BanDurationMs   int     `json:"ban_duration_ms"`
+}
+
+// scoreConfig is scoreParams as configured, where weights left out take the
+// defaults and zero weights turn events off. A zero half-life takes the
+// default too.
+type scoreConfig struct {
+	ValidMsg        *float64 `json:"valid_msg"`
+	InvalidMsg      *float64 `json:"invalid_msg"`
+	StreamError     *float64 `json:"stream_error"`
+	RateLimited     *float64 `json:"rate_limited"`
+	UptimeMinute    *float64 `json:"uptime_minute"`
+	HalfLifeMs      int      `json:"half_life_ms"`
+	DisconnectBelow float64  `json:"disconnect_below"`
+	BanBelow        float64  `json:"ban_below"`
+	BanDurationMs   int      `json:"ban_duration_ms"`
+}
+
+var defaultScoreParams = scoreParams{
+	ValidMsg:     1,
+	InvalidMsg:   -20,
+	StreamError:  -5,
+	RateLimited:  -10,
+	UptimeMinute: 1,
+	HalfLifeMs:   int(time.Hour / time.Millisecond),
+}
+
+// how often connected peers are credited for uptime and scores are swept
+const scoreInterval = 10 * time.Second
+
+type peerScore struct {
+	score   float64
+	updated time.Time
+	// event counts, for peerScores
+	valid        uint64
+	invalid      uint64
+	streamErrors uint64
+	rateLimited  uint64
+}
+
+// scoreBook keeps a score for each peer we have heard from.
+type scoreBook struct {
+	params   scoreParams
+	halfLife time.Duration
+
+	lock   sync.Mutex
+	scores map[peer.ID]*peerScore
+}
+
+// newScoreBook uses the defaults for anything params leaves out.
+func newScoreBook(params *scoreConfig) (*scoreBook, error) {
+	p := defaultScoreParams
+	if params != nil {
+		p.DisconnectBelow, p.BanBelow, p.BanDurationMs = params.DisconnectBelow, params.BanBelow, params.BanDurationMs
+		for _, w := range []struct{ dst, src *float64 }{
+			{&p.ValidMsg, params.ValidMsg},
+			{&p.InvalidMsg, params.InvalidMsg},
+			{&p.StreamError, params.StreamError},
+			{&p.RateLimited, params.RateLimited},
+			{&p.UptimeMinute, params.UptimeMinute},
+		} {
+			if w.src != nil {
+				*w.dst = *w.src
+			}
+		}
+		if params.HalfLifeMs > 0 {
+			p.HalfLifeMs = params.HalfLifeMs
+		}
+	}
+	if p.DisconnectBelow > 0 || p.BanBelow > 0 {
+		return nil, errors.New("score thresholds must be negative, or zero to disable them")
+	}
+	return &scoreBook{params: p, halfLife: time.Duration(p.HalfLifeMs) * time.Millisecond, scores: make(map[peer.ID]*peerScore)}, nil
+}
+
+// decayed returns s's score as of now, updating it. Callers must hold
+// b.lock.
+func (b *scoreBook) decayed(s *peerScore, now time.Time) float64 {
+	elapsed := now.Sub(s.updated)
+	s.score *= math.Pow(0.5, float64(elapsed)/float64(b.halfLife))
+	s.updated = now
+	return s.score
+}
+
+// add adds weight to p's score, counting the event with count, and returns
+// the new score.
+func (b *scoreBook) add(p peer.ID, weight float64, count func(*peerScore)) float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	s, ok := b.scores[p]
+	if !ok {
+		s = &peerScore{updated: now}
+		b.scores[p] = s
+	}
+	b.decayed(s, now)
+	s.score += weight
+	if count != nil {
+		count(s)
+	}
+	return s.score
+}
+
+// judge disconnects or bans p if its score has fallen below a threshold.
+func (app *app) judge(p peer.ID, score float64) {
+	params := app.Scores.params
+	switch {
+	case params.BanBelow != 0 && score <= params.BanBelow:
+		if app.Bans.banned(p) {
+			return
+		}
+		app.P2p.Logger.Warningf("banning peer %s for its score of %.1f", p.Pretty(), score)
+		reason := fmt.Sprintf("score %.1f", score)
+		if err := app.Bans.add(p, time.Duration(params.BanDurationMs)*time.Millisecond, reason); err != nil {
+			app.P2p.Logger.Errorf("failed to save ban of %s: %v", p.Pretty(), err)
+		}
+		go app.P2p.Host.Network().ClosePeer(p)
+	case params.DisconnectBelow != 0 && score <= params.DisconnectBelow:
+		if len(app.P2p.Host.Network().ConnsToPeer(p)) == 0 {
+			return
+		}
+		app.P2p.Logger.Warningf("disconnecting peer %s for its score of %.1f", p.Pretty(), score)
+		go app.P2p.Host.Network().ClosePeer(p)
+	}
+}
+
+// score records an event for p and acts on the resulting score.
+func (app *app) score(p peer.ID, weight func(scoreParams) float64, count func(*peerScore)) {
+	if p == app.P2p.Host.ID() {
+		return
+	}
+	app.judge(p, app.Scores.add(p, weight(app.Scores.params), count))
+}
+
+func (app *app) scoreValidation(p peer.ID, valid bool) {
+	if valid {
+		app.score(p, func(w scoreParams) float64 { return w.ValidMsg }, func(s *peerScore) { s.valid++ })
+	} else {
+		app.score(p, func(w scoreParams) float64 { return w.InvalidMsg }, func(s *peerScore) { s.invalid++ })
+	}
+}
+
+func (app *app) scoreStreamError(p peer.ID) {
+	app.score(p, func(w scoreParams) float64 { return w.StreamError }, func(s *peerScore) { s.streamErrors++ })
+}
+
+func (app *app) scoreRateLimited(p peer.ID) {
+	app.score(p, func(w scoreParams) float64 { return w.RateLimited }, func(s *peerScore) { s.rateLimited++ })
+}
+
+// creditUptime credits connected peers for their uptime every scoreInterval,
+// and forgets disconnected peers whose scores have decayed to nothing, until
+// ctx is done.
+func (app *app) creditUptime(ctx context.Context) {
+	ticker := time.NewTicker(scoreInterval)
+	defer ticker.Stop()
+	credit := app.Scores.params.UptimeMinute * float64(scoreInterval) / float64(time.Minute)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, p := range app.P2p.Host.Network().Peers() {
+			app.score(p, func(scoreParams) float64 { return credit }, nil)
+		}
+
+		app.Scores.lock.Lock()
+		now := time.Now()
+		for p, s := range app.Scores.scores {
+			if math.Abs(app.Scores.decayed(s, now)) < 0.01 && len(app.P2p.Host.Network().ConnsToPeer(p)) == 0 {
+				delete(app.Scores.scores, p)
+			}
+		}
+		app.Scores.lock.Unlock()
+	}
+}
+
+type peerScoresMsg struct{}
+
+type peerScoreInfo struct {
+	PeerID       string  `json:"peer_id"`
+	Score        float64 `json:"score"`
+	Valid        uint64  `json:"valid_msgs"`
+	Invalid      uint64  `json:"invalid_msgs"`
+	StreamErrors uint64  `json:"stream_errors"`
+	RateLimited  uint64  `json:"rate_limited"`
+}
+
+type peerScoresResult struct {
+	Params scoreParams     `json:"params"`
+	Peers  []peerScoreInfo `json:"peers"`
+}
+
+// peerScores lists peers' scores, lowest first.
+func (ps *peerScoresMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	b := app.Scores
+	b.lock.Lock()
+	now := time.Now()
+	infos := make([]peerScoreInfo, 0, len(b.scores))
+	for p, s := range b.scores {
+		infos = append(infos, peerScoreInfo{
+			PeerID:       peer.IDB58Encode(p),
+			Score:        b.decayed(s, now),
+			Valid:        s.valid,
+			Invalid:      s.invalid,
+			StreamErrors: s.streamErrors,
+			RateLimited:  s.rateLimited,
+		})
+	}
+	b.lock.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Score < infos[j].Score })
+	return peerScoresResult{Params: b.params, Peers: infos}, nil
+}
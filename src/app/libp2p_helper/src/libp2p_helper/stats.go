@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// trafficCounts is the traffic over one stream, or summed over several.
+type trafficCounts struct {
+	// Streams is the number of streams summed, it is omitted for a single
+	// stream.
+	Streams  uint64 `json:"streams,omitempty"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	MsgsIn   uint64 `json:"msgs_in"`
+	MsgsOut  uint64 `json:"msgs_out"`
+	Errors   uint64 `json:"errors"`
+	// OpenMs is how long the stream was open, or the sum for several.
+	OpenMs int64 `json:"open_ms"`
+	// Refused is the number of inbound streams reset by the protocol's
+	// stream limits, only reported per protocol.
+	Refused uint64 `json:"refused,omitempty"`
+}
+
+func (c *trafficCounts) add(o trafficCounts) {
+	c.Streams += o.Streams
+	c.BytesIn += o.BytesIn
+	c.BytesOut += o.BytesOut
+	c.MsgsIn += o.MsgsIn
+	c.MsgsOut += o.MsgsOut
+	c.Errors += o.Errors
+	c.OpenMs += o.OpenMs
+	c.Refused += o.Refused
+}
+
+// trafficStats sums the traffic of finished streams by protocol and by peer.
+// Streams still open are added in when the stats are reported.
+type trafficStats struct {
+	lock       sync.Mutex
+	byProtocol map[string]*trafficCounts
+	byPeer     map[string]*trafficCounts
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{byProtocol: make(map[string]*trafficCounts), byPeer: make(map[string]*trafficCounts)}
+}
+
+func addCounts(m map[string]*trafficCounts, key string, c trafficCounts) {
+	total, ok := m[key]
+	if !ok {
+		total = &trafficCounts{}
+		m[key] = total
+	}
+	total.add(c)
+}
+
+// record adds the traffic of one stream, or part of one if streams is 0.
+func (t *trafficStats) record(protocol string, peer string, c trafficCounts) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	addCounts(t.byProtocol, protocol, c)
+	addCounts(t.byPeer, peer, c)
+}
+
+// snapshot returns copies of the totals, so that live streams can be added.
+func (t *trafficStats) snapshot() (map[string]*trafficCounts, map[string]*trafficCounts) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	copyCounts := func(m map[string]*trafficCounts) map[string]*trafficCounts {
+		res := make(map[string]*trafficCounts, len(m))
+		for k, c := range m {
+			res[k] = &trafficCounts{}
+			res[k].add(*c)
+		}
+		return res
+	}
+	return copyCounts(t.byProtocol), copyCounts(t.byPeer)
+}
+
+// stats returns the traffic over the stream so far.
+func (s *stream) stats() trafficCounts {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return trafficCounts{
+		BytesIn:  s.bytesIn,
+		BytesOut: s.bytesOut,
+		MsgsIn:   s.msgsIn,
+		MsgsOut:  s.msgsOut,
+		Errors:   s.errors,
+		OpenMs:   int64(time.Since(s.Opened) / time.Millisecond),
+	}
+}
+
+func (s *stream) countError() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errors++
+}
+
+type streamStatsMsg struct{}
+
+type streamStatsEntry struct {
+	StreamIdx int           `json:"stream_idx"`
+	PeerID    string        `json:"peer_id"`
+	Protocol  string        `json:"protocol"`
+	Stats     trafficCounts `json:"stats"`
+}
+
+type streamStatsResult struct {
+	Streams   []streamStatsEntry        `json:"streams"`
+	Protocols map[string]*trafficCounts `json:"protocols"`
+	Peers     map[string]*trafficCounts `json:"peers"`
+}
+
+// streamStats reports the traffic of each open stream, and totals for every
+// stream since the helper started by protocol and by peer.
+func (ss *streamStatsMsg) run(app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	byProtocol, byPeer := app.Traffic.snapshot()
+	streams := app.listStreams()
+	res := streamStatsResult{Streams: make([]streamStatsEntry, len(streams)), Protocols: byProtocol, Peers: byPeer}
+	for i, s := range streams {
+		entry := streamStatsEntry{
+			StreamIdx: s.Idx,
+			PeerID:    s.Conn().RemotePeer().Pretty(),
+			Protocol:  string(s.Protocol()),
+			Stats:     s.stats(),
+		}
+		res.Streams[i] = entry
+		live := entry.Stats
+		live.Streams = 1
+		addCounts(byProtocol, entry.Protocol, live)
+		addCounts(byPeer, entry.PeerID, live)
+	}
+
+	app.StreamsLock.Lock()
+	for protocol, limits := range app.StreamLimits {
+		addCounts(byProtocol, protocol, trafficCounts{Refused: limits.refusals()})
+	}
+	app.StreamsLock.Unlock()
+
+	return res, nil
+}
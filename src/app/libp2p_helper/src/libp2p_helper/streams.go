@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	net "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Deadlines for opening a stream and for each write to it, when the caller
+// doesn't give its own.
+const (
+	defaultOpenStreamTimeout = 30 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+)
+
+type streamOpts struct {
+	MaxFrame    int
+	Window      int
+	IdleTimeout time.Duration
+	Bandwidth   *bandwidthLimiter
+}
+
+// stream is a libp2p stream together with the helper's settings for it.
+type stream struct {
+	net.Stream
+	Idx int
+	// MaxFrame is the largest message allowed on a framed stream. Framed
+	// streams carry varint length-prefixed messages, and the helper sends
+	// and delivers whole messages. Zero means the stream isn't framed.
+	MaxFrame int
+	// Credit is nil if reads from the stream aren't flow controlled.
+	Credit *readCredit
+	Opened time.Time
+
+	lock         sync.Mutex
+	readClosed   bool
+	writeClosed  bool
+	remoteClosed bool
+	bytesIn      uint64
+	bytesOut     uint64
+	msgsIn       uint64
+	msgsOut      uint64
+	errors       uint64
+	idleTimeout  time.Duration
+	idleTimer    *time.Timer
+	// creditWait is set while the reader waits for read credit, which
+	// pauses the idle timeout
+	creditWait bool
+	removed    bool
+	// called when the stream is removed from the registry
+	onRemove func()
+	// why the helper reset the stream, reported in streamLost
+	abortReason string
+	// readDone is set once the reader has reported how the stream ended.
+	// A stream aborted after that is reported lost by onLost instead.
+	readDone bool
+	onLost   func(reason string)
+}
+
+func newStream(s net.Stream, idx int, opts streamOpts) *stream {
+	stream := &stream{Stream: opts.Bandwidth.throttle(s), Idx: idx, MaxFrame: opts.MaxFrame, Credit: newReadCredit(opts.Window), Opened: time.Now()}
+	if opts.IdleTimeout > 0 {
+		stream.idleTimeout = opts.IdleTimeout
+		stream.idleTimer = time.AfterFunc(opts.IdleTimeout, func() {
+			stream.abort(fmt.Sprintf("timeout: idle for %v", opts.IdleTimeout))
+		})
+	}
+	return stream
+}
+
+// abort resets the stream, recording why so that the reader can report it,
+// or reporting it lost itself if the reader has already finished.
+func (s *stream) abort(reason string) error {
+	s.lock.Lock()
+	if s.abortReason == "" {
+		s.abortReason = reason
+	}
+	reason = s.abortReason
+	var lost func(string)
+	if s.readDone && !s.removed {
+		lost = s.onLost
+	}
+	s.lock.Unlock()
+	s.Credit.close()
+	err := s.Reset()
+	if lost != nil {
+		lost(reason)
+	}
+	return err
+}
+
+// finishReading marks the reader as done, returning why the stream was
+// aborted if it was.
+func (s *stream) finishReading() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readDone = true
+	return s.abortReason
+}
+
+func (s *stream) lostReason() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.abortReason
+}
+
+// active postpones the idle timeout. Callers must hold s.lock.
+func (s *stream) active() {
+	if s.idleTimer != nil && !s.creditWait && !s.removed {
+		s.idleTimer.Reset(s.idleTimeout)
+	}
+}
+
+// waitCredit is Credit.wait with the idle timeout paused, as a stream
+// waiting for credit is only idle because the coda process is.
+func (s *stream) waitCredit(max int) (int, error) {
+	if s.Credit == nil {
+		return max, nil
+	}
+	s.setCreditWait(true)
+	defer s.setCreditWait(false)
+	return s.Credit.wait(max)
+}
+
+func (s *stream) setCreditWait(waiting bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if waiting && s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.creditWait = waiting
+	if !waiting {
+		s.active()
+	}
+}
+
+func (app *app) addStream(s *stream) {
+	s.lock.Lock()
+	s.onLost = func(reason string) { app.streamLost(s, reason) }
+	s.lock.Unlock()
+	app.StreamsLock.Lock()
+	defer app.StreamsLock.Unlock()
+	app.Streams[s.Idx] = s
+}
+
+func (app *app) getStream(idx int) (*stream, bool) {
+	app.StreamsLock.Lock()
+	defer app.StreamsLock.Unlock()
+	s, ok := app.Streams[idx]
+	return s, ok
+}
+
+// removeStream forgets a stream which was reset or closed in both
+// directions, so that further operations on it fail. It returns false if the
+// stream was already removed.
+func (app *app) removeStream(s *stream) bool {
+	return app.forgetStream(s, false)
+}
+
+// forgetStream is removeStream, first counting an error against the stream
+// if it was lost, so that the traffic stats include it.
+func (app *app) forgetStream(s *stream, lost bool) bool {
+	app.StreamsLock.Lock()
+	defer app.StreamsLock.Unlock()
+	if _, ok := app.Streams[s.Idx]; !ok {
+		return false
+	}
+	if lost {
+		s.countError()
+	}
+	delete(app.Streams, s.Idx)
+	s.lock.Lock()
+	s.removed = true
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.lock.Unlock()
+	stats := s.stats()
+	stats.Streams = 1
+	app.Traffic.record(string(s.Protocol()), s.Conn().RemotePeer().Pretty(), stats)
+	if s.onRemove != nil {
+		s.onRemove()
+	}
+	return true
+}
+
+// streamLost removes a stream that failed or was aborted, and tells the coda
+// process. Streams already removed, such as those reset by resetStream,
+// ended as the coda process asked, so they aren't reported.
+func (app *app) streamLost(s *stream, reason string) {
+	if !app.forgetStream(s, true) {
+		return
+	}
+	app.writeMsg(streamLostUpcall{
+		Upcall:    "streamLost",
+		StreamIdx: s.Idx,
+		Reason:    reason,
+		Stats:     s.stats(),
+	})
+}
+
+// connOpen reports whether c is still one of our connections. Streams on a
+// connection that has closed fail through no fault of their own.
+func (app *app) connOpen(c net.Conn) bool {
+	for _, open := range app.P2p.Host.Network().ConnsToPeer(c.RemotePeer()) {
+		if open == c {
+			return true
+		}
+	}
+	return false
+}
+
+// removeIfClosed removes the stream if neither side will write to it again.
+func (app *app) removeIfClosed(s *stream) {
+	s.lock.Lock()
+	closed := s.writeClosed && s.remoteClosed
+	s.lock.Unlock()
+	if closed {
+		app.removeStream(s)
+	}
+}
+
+// abortConnStreams aborts the streams on a closed connection. Most are
+// reported lost by their readers anyway, but not those the remote had
+// closed, which would otherwise linger until the coda process closes them.
+func (app *app) abortConnStreams(c net.Conn) {
+	for _, s := range app.listStreams() {
+		if s.Conn() == c {
+			s.abort("connection closed")
+		}
+	}
+}
+
+func (app *app) listStreams() []*stream {
+	app.StreamsLock.Lock()
+	defer app.StreamsLock.Unlock()
+	streams := make([]*stream, 0, len(app.Streams))
+	for _, s := range app.Streams {
+		streams = append(streams, s)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Idx < streams[j].Idx })
+	return streams
+}
+
+// streamLimits caps the number of concurrent inbound streams for a protocol,
+// in total and per peer. Zero means unlimited.
+type streamLimits struct {
+	MaxStreams        int
+	MaxStreamsPerPeer int
+
+	lock    sync.Mutex
+	total   int
+	perPeer map[peer.ID]int
+	refused uint64
+}
+
+func newStreamLimits(maxStreams int, maxPerPeer int) *streamLimits {
+	return &streamLimits{MaxStreams: maxStreams, MaxStreamsPerPeer: maxPerPeer, perPeer: make(map[peer.ID]int)}
+}
+
+// acquire reserves a stream for p, returning false (and counting the
+// refusal) if that would exceed a limit.
+func (l *streamLimits) acquire(p peer.ID) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if (l.MaxStreams > 0 && l.total >= l.MaxStreams) ||
+		(l.MaxStreamsPerPeer > 0 && l.perPeer[p] >= l.MaxStreamsPerPeer) {
+		l.refused++
+		return false
+	}
+	l.total++
+	l.perPeer[p]++
+	return true
+}
+
+func (l *streamLimits) release(p peer.ID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.total--
+	if l.perPeer[p]--; l.perPeer[p] <= 0 {
+		delete(l.perPeer, p)
+	}
+}
+
+func (l *streamLimits) refusals() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.refused
+}
+
+// readCredit is the number of bytes the coda process is willing to receive
+// from a stream. The helper stops reading from the stream when it runs out,
+// which pushes back on the remote.
+//
+// Note that mplex can't apply backpressure to a single stream: it stalls the
+// whole connection, and resets the stream if it isn't read from for
+// mplex.ReceiveTimeout. Grant credit promptly.
+type readCredit struct {
+	cond     *sync.Cond
+	avail    int
+	closed   bool
+	released bool
+}
+
+func newReadCredit(window int) *readCredit {
+	if window <= 0 {
+		return nil
+	}
+	return &readCredit{cond: sync.NewCond(&sync.Mutex{}), avail: window}
+}
+
+var errCreditClosed = errors.New("stream reset while waiting for read credit")
+
+// wait blocks until there is credit, and returns how many bytes (at most
+// max) may be read.
+func (c *readCredit) wait(max int) (int, error) {
+	if c == nil {
+		return max, nil
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	for c.avail <= 0 && !c.closed && !c.released {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return 0, errCreditClosed
+	}
+	if c.released || c.avail >= max {
+		return max, nil
+	}
+	return c.avail, nil
+}
+
+// use consumes credit for n bytes read. A whole frame is always delivered,
+// so this may leave the credit negative.
+func (c *readCredit) use(n int) {
+	if c == nil {
+		return
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	c.avail -= n
+}
+
+func (c *readCredit) grant(n int) {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	c.avail += n
+	c.cond.Broadcast()
+}
+
+// release lifts flow control, so that a stream whose read side is closed can
+// be drained.
+func (c *readCredit) release() {
+	if c == nil {
+		return
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	c.released = true
+	c.cond.Broadcast()
+}
+
+// close wakes up a reader waiting for credit on a stream which was reset.
+func (c *readCredit) close() {
+	if c == nil {
+		return
+	}
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+}
+
+func (s *stream) framed() bool {
+	return s.MaxFrame > 0
+}
+
+// closeWrite closes our end of the stream, the remote reads EOF once it has
+// received everything we sent.
+func (s *stream) closeWrite() error {
+	s.lock.Lock()
+	s.writeClosed = true
+	s.lock.Unlock()
+	return s.Close()
+}
+
+// closeRead stops delivering data from the stream. The stream is still
+// drained, as leaving data unread would stall the connection.
+func (s *stream) closeRead() {
+	s.lock.Lock()
+	s.readClosed = true
+	s.lock.Unlock()
+	s.Credit.release()
+}
+
+func (s *stream) isReadClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.readClosed
+}
+
+func (s *stream) isWriteClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.writeClosed
+}
+
+func (s *stream) setRemoteClosed() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.remoteClosed = true
+}
+
+func (s *stream) counts() (in uint64, out uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bytesIn, s.bytesOut
+}
+
+func (s *stream) countIn(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.bytesIn += uint64(n)
+	if n > 0 {
+		s.msgsIn++
+	}
+	s.active()
+}
+
+func (s *stream) countOut(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.bytesOut += uint64(n)
+	if n > 0 {
+		s.msgsOut++
+	}
+	s.active()
+}
+
+func directionString(d net.Direction) string {
+	switch d {
+	case net.DirInbound:
+		return "inbound"
+	case net.DirOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+type frameTooLarge struct {
+	size uint64
+	max  int
+}
+
+func (e frameTooLarge) Error() string {
+	return fmt.Sprintf("frame of %d bytes exceeds maximum of %d", e.size, e.max)
+}
+
+// readFrame reads one length-prefixed message from r.
+func readFrame(r *bufio.Reader, max int) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(max) {
+		return nil, frameTooLarge{size: size, max: max}
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeMsg writes data to the stream, as a single frame if it is framed.
+func (s *stream) writeMsg(data []byte) error {
+	if !s.framed() {
+		n, err := s.Write(data)
+		s.countOut(n)
+		if err != nil {
+			s.countError()
+		}
+		return err
+	}
+	if len(data) > s.MaxFrame {
+		return frameTooLarge{size: uint64(len(data)), max: s.MaxFrame}
+	}
+	n, err := writeFrame(s, data)
+	s.countOut(n)
+	if err != nil {
+		s.countError()
+	}
+	return err
+}
+
+// writeFrame writes data to w as one length-prefixed message.
+func writeFrame(w io.Writer, data []byte) (int, error) {
+	buf := make([]byte, binary.MaxVarintLen64+len(data))
+	n := binary.PutUvarint(buf, uint64(len(data)))
+	n += copy(buf[n:], data)
+	return w.Write(buf[:n])
+}
+
+// writeMsgTimeout is writeMsg with a deadline. The stream is reset if the
+// deadline passes, as we can't tell how much of data was sent.
+func (s *stream) writeMsgTimeout(data []byte, timeout time.Duration) error {
+	s.SetWriteDeadline(time.Now().Add(timeout))
+	defer s.SetWriteDeadline(time.Time{})
+	err := s.writeMsg(data)
+	if te, ok := err.(interface{ Timeout() bool }); ok && te.Timeout() {
+		s.abort(fmt.Sprintf("timeout: write took longer than %v", timeout))
+	}
+	return err
+}
+
+// readMsgs calls f with each message read from the stream until it fails,
+// returning io.EOF if the remote closed the stream cleanly. Unframed streams
+// yield whatever each Read returns.
+func (s *stream) readMsgs(f func([]byte)) error {
+	if s.framed() {
+		r := bufio.NewReader(s)
+		for {
+			if _, err := s.waitCredit(1); err != nil {
+				return err
+			}
+			msg, err := readFrame(r, s.MaxFrame)
+			if err != nil {
+				return err
+			}
+			s.Credit.use(len(msg))
+			s.countIn(len(msg))
+			f(msg)
+		}
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.waitCredit(len(buf))
+		if err != nil {
+			return err
+		}
+		len, err := s.Read(buf[:n])
+		s.Credit.use(len)
+		s.countIn(len)
+		if len != 0 {
+			f(buf[:len])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package codanet
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	b58 "github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/blake2b"
+)
+
+// TraceEvent is one line of a pubsub trace file.
+type TraceEvent struct {
+	// Unix time in nanoseconds. Comparing traces from several nodes is only
+	// meaningful if their clocks are synchronized.
+	Time   int64  `json:"ts"`
+	Type   string `json:"type"`
+	MsgID  string `json:"msg_id,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	Peer   string `json:"peer,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// MessageID identifies a pubsub payload the same way on every node, so that
+// publishes and deliveries of one message can be matched up.
+func MessageID(data []byte) string {
+	hash := blake2b.Sum256(data)
+	return b58.Encode(hash[:])
+}
+
+// ChunkTopicSuffix marks the topics the helper publishes chunks of large
+// payloads on. Each chunk starts with the hash of the whole payload.
+const ChunkTopicSuffix = "/chunks"
+
+// topicMessageID is MessageID for a message on topic, giving chunks the ID
+// of the payload they are part of.
+func topicMessageID(topic string, data []byte) string {
+	if strings.HasSuffix(topic, ChunkTopicSuffix) && len(data) >= blake2b.Size256 {
+		return b58.Encode(data[:blake2b.Size256])
+	}
+	return MessageID(data)
+}
+
+// Tracer writes pubsub events to a JSON-lines file. A nil *Tracer discards
+// everything, so callers needn't check whether tracing is enabled.
+type Tracer struct {
+	lock sync.Mutex
+	file *os.File
+	out  *bufio.Writer
+}
+
+// NewTracer appends trace events to the file at path.
+func NewTracer(path string) (*Tracer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracer{file: file, out: bufio.NewWriter(file)}, nil
+}
+
+// Trace records evt, timestamping it if it has no time yet.
+func (t *Tracer) Trace(evt TraceEvent) {
+	if t == nil {
+		return
+	}
+	if evt.Time == 0 {
+		evt.Time = time.Now().UnixNano()
+	}
+	bytes, err := json.Marshal(evt)
+	if err != nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.out.Write(bytes)
+	t.out.WriteByte('\n')
+	t.out.Flush()
+}
+
+// Close flushes and closes the trace file.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.out.Flush()
+	return t.file.Close()
+}
+
+// how long tracingRouter remembers messages to report duplicates, matching
+// the pubsub seen-messages cache.
+const traceSeenTTL = 120 * time.Second
+
+// tracingRouter wraps floodsub to trace the events only the router sees.
+// Floodsub has no mesh, so there are no graft or prune events to trace.
+// pubsub calls the router from its event loop alone, so no locking is needed.
+type tracingRouter struct {
+	pubsub.FloodSubRouter
+	tracer *Tracer
+	seen   map[string]time.Time
+	sweep  time.Time
+}
+
+func newTracingRouter(tracer *Tracer) *tracingRouter {
+	return &tracingRouter{tracer: tracer, seen: make(map[string]time.Time)}
+}
+
+func (r *tracingRouter) Protocols() []protocol.ID {
+	return []protocol.ID{pubsub.FloodSubID}
+}
+
+func (r *tracingRouter) AddPeer(p peer.ID, proto protocol.ID) {
+	r.tracer.Trace(TraceEvent{Type: "add_peer", Peer: p.Pretty()})
+	r.FloodSubRouter.AddPeer(p, proto)
+}
+
+func (r *tracingRouter) RemovePeer(p peer.ID) {
+	r.tracer.Trace(TraceEvent{Type: "remove_peer", Peer: p.Pretty()})
+	r.FloodSubRouter.RemovePeer(p)
+}
+
+// markSeen reports whether msg was already seen.
+func (r *tracingRouter) markSeen(msg *pb.Message) bool {
+	now := time.Now()
+	if now.After(r.sweep) {
+		for id, t := range r.seen {
+			if now.Sub(t) > traceSeenTTL {
+				delete(r.seen, id)
+			}
+		}
+		r.sweep = now.Add(traceSeenTTL)
+	}
+	id := string(msg.GetFrom()) + string(msg.GetSeqno())
+	if _, ok := r.seen[id]; ok {
+		return true
+	}
+	r.seen[id] = now
+	return false
+}
+
+func (r *tracingRouter) HandleRPC(rpc *pubsub.RPC) {
+	// pubsub doesn't tell routers who sent rpc, so duplicates are traced
+	// without a peer
+	for _, msg := range rpc.GetPublish() {
+		if r.markSeen(msg) {
+			for _, topic := range msg.GetTopicIDs() {
+				r.tracer.Trace(TraceEvent{Type: "duplicate", MsgID: topicMessageID(topic, msg.GetData()), Topic: topic})
+			}
+		}
+	}
+	for _, sub := range rpc.GetSubscriptions() {
+		typ := "peer_join"
+		if !sub.GetSubscribe() {
+			typ = "peer_leave"
+		}
+		r.tracer.Trace(TraceEvent{Type: typ, Topic: sub.GetTopicid()})
+	}
+	r.FloodSubRouter.HandleRPC(rpc)
+}
+
+func (r *tracingRouter) Publish(from peer.ID, msg *pb.Message) {
+	r.markSeen(msg)
+	for _, topic := range msg.GetTopicIDs() {
+		r.tracer.Trace(TraceEvent{Type: "forward", MsgID: topicMessageID(topic, msg.GetData()), Topic: topic, Peer: from.Pretty()})
+	}
+	r.FloodSubRouter.Publish(from, msg)
+}
+
+func (r *tracingRouter) Join(topic string) {
+	r.tracer.Trace(TraceEvent{Type: "join", Topic: topic})
+	r.FloodSubRouter.Join(topic)
+}
+
+func (r *tracingRouter) Leave(topic string) {
+	r.tracer.Trace(TraceEvent{Type: "leave", Topic: topic})
+	r.FloodSubRouter.Leave(topic)
+}
@@ -0,0 +1,120 @@
+// trace_summary reads the pubsub trace files written by several helpers (see
+// the trace_file configure option) and reports, for each published message,
+// how long it took to be delivered on the other nodes.
+//
+// Usage: go run trace_summary/main.go node1.jsonl node2.jsonl ...
+//
+// Latencies are computed from the nodes' wall clocks, so they are only as
+// accurate as the clock synchronization between the nodes.
+package main
+
+import (
+	"bufio"
+	"codanet"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+type message struct {
+	ID        string
+	Topic     string
+	Publisher string
+	Published int64
+	// first delivery time per node
+	Delivered map[string]int64
+}
+
+func readTrace(path string, msgs map[string]*message) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lines := bufio.NewScanner(f)
+	lines.Buffer(make([]byte, 64*1024), 1<<20)
+	for lines.Scan() {
+		var evt codanet.TraceEvent
+		if err := json.Unmarshal(lines.Bytes(), &evt); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if evt.MsgID == "" || (evt.Type != "publish" && evt.Type != "deliver") {
+			continue
+		}
+		msg, ok := msgs[evt.MsgID]
+		if !ok {
+			msg = &message{ID: evt.MsgID, Topic: evt.Topic, Delivered: make(map[string]int64)}
+			msgs[evt.MsgID] = msg
+		}
+		switch evt.Type {
+		case "publish":
+			if msg.Publisher == "" || evt.Time < msg.Published {
+				msg.Publisher = path
+				msg.Published = evt.Time
+			}
+		case "deliver":
+			if t, ok := msg.Delivered[path]; !ok || evt.Time < t {
+				msg.Delivered[path] = evt.Time
+			}
+		}
+	}
+	return lines.Err()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		log.Fatalf("usage: %s TRACE_FILE...", os.Args[0])
+	}
+	nodes := os.Args[1:]
+
+	msgs := make(map[string]*message)
+	for _, path := range nodes {
+		if err := readTrace(path, msgs); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	published := make([]*message, 0, len(msgs))
+	unknown := 0
+	for _, msg := range msgs {
+		if msg.Publisher == "" {
+			unknown++
+			continue
+		}
+		published = append(published, msg)
+	}
+	sort.Slice(published, func(i, j int) bool { return published[i].Published < published[j].Published })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MESSAGE\tTOPIC\tPUBLISHER\tREACHED\tMIN\tMEDIAN\tP90\tMAX")
+	for _, msg := range published {
+		var latencies []time.Duration
+		for node, t := range msg.Delivered {
+			if node != msg.Publisher {
+				latencies = append(latencies, time.Duration(t-msg.Published))
+			}
+		}
+		reached := fmt.Sprintf("%d/%d", len(latencies), len(nodes)-1)
+		if len(latencies) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t-\t-\t-\t-\n", msg.ID, msg.Topic, msg.Publisher, reached)
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%v\t%v\t%v\n", msg.ID, msg.Topic, msg.Publisher, reached,
+			latencies[0], percentile(latencies, 0.5), percentile(latencies, 0.9), latencies[len(latencies)-1])
+	}
+	w.Flush()
+
+	if unknown > 0 {
+		fmt.Fprintf(os.Stderr, "%d messages were delivered but never published in these traces\n", unknown)
+	}
+}
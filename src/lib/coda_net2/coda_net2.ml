@@ -20,6 +20,9 @@ let of_b58_data = function
 let to_b58_data (s : string) =
   B58.encode alphabet (Bytes.of_string s) |> Bytes.to_string
 
+(* Pubsub payloads are base64, as base58 takes minutes on the largest ones. *)
+let to_b64_data (s : string) = Base64.encode_exn s
+
 let to_int_res x =
   match Yojson.Safe.Util.to_int_option x with
   | Some i ->
@@ -121,6 +124,14 @@ module Helper = struct
       let name = "closeStream"
     end
 
+    module Close_stream_write = struct
+      type input = {stream_idx: int} [@@deriving yojson]
+
+      type output = string [@@deriving yojson]
+
+      let name = "closeStreamWrite"
+    end
+
     module Remove_stream_handler = struct
       type input = {protocol: string} [@@deriving yojson]
 
@@ -141,9 +152,10 @@ module Helper = struct
     end
 
     module Publish = struct
-      type input = {topic: string; data: string} [@@deriving yojson]
+      type input = {topic: string; data: string; require_peers: bool}
+      [@@deriving yojson]
 
-      type output = string [@@deriving yojson]
+      type output = {message_id: string; peers: int} [@@deriving yojson]
 
       let name = "publish"
     end
@@ -214,7 +226,10 @@ module Helper = struct
       type input = {peer: string; protocol: string} [@@deriving yojson]
 
       type output =
-        {stream_idx: int; remote_addr: string; remote_peerid: string}
+        { stream_idx: int
+        ; remote_addr: string
+        ; remote_peerid: string
+        ; protocol: string }
       [@@deriving yojson]
 
       let name = "openStream"
@@ -229,7 +244,7 @@ module Helper = struct
     end
 
     module Add_peer = struct
-      type input = {multiaddr: string} [@@deriving yojson]
+      type input = {multiaddr: string; seed: bool} [@@deriving yojson]
 
       type output = string [@@deriving yojson]
 
@@ -299,12 +314,15 @@ module Helper = struct
       match who_closed with
       | `Us -> (
           match%map
-            do_rpc net (module Rpcs.Close_stream) {stream_idx= stream.idx}
+            do_rpc net
+              (module Rpcs.Close_stream_write)
+              {stream_idx= stream.idx}
           with
-          | Ok "closeStream success" ->
+          | Ok "closeStreamWrite success" ->
               ()
           | Ok v ->
-              failwithf "helper broke RPC protocol: closeStream got %s" v ()
+              failwithf "helper broke RPC protocol: closeStreamWrite got %s" v
+                ()
           | Error e ->
               Error.raise e )
       | `Them ->
@@ -439,28 +457,48 @@ module Helper = struct
             Error "expected a string"
     end
 
+    module Payload : sig
+      type t = string [@@deriving yojson]
+    end = struct
+      type t = string
+
+      let to_yojson s = `String (to_b64_data s)
+
+      let of_yojson = function
+        | `String s -> (
+          match Base64.decode s with
+          | Ok data ->
+              Ok data
+          | Error (`Msg e) ->
+              Error e )
+        | _ ->
+            Error "expected a string"
+    end
+
     module Publish = struct
-      type t = {upcall: string; subscription_idx: int; data: Data.t}
+      type t = {upcall: string; subscription_idx: int; data: Payload.t}
       [@@deriving yojson]
     end
 
     module Validate = struct
       type t =
         { peer_id: string
-        ; data: Data.t
+        ; data: Payload.t
         ; seqno: int
         ; upcall: string
         ; subscription_idx: int }
       [@@deriving yojson]
     end
 
+    (* These also carry the stream's traffic stats, which we don't use. *)
     module Stream_lost = struct
       type t = {upcall: string; stream_idx: int; reason: string}
-      [@@deriving yojson]
+      [@@deriving yojson {strict= false}]
     end
 
     module Stream_read_complete = struct
-      type t = {upcall: string; stream_idx: int} [@@deriving yojson]
+      type t = {upcall: string; stream_idx: int}
+      [@@deriving yojson {strict= false}]
     end
 
     module Incoming_stream_msg = struct
@@ -606,6 +644,10 @@ module Helper = struct
     | "discoveredPeer" ->
         let%map p = Discovered_peer.of_yojson v |> or_error in
         Option.iter t.new_peer_callback ~f:(fun cb -> cb p.peer_id p.multiaddrs)
+    (* A peer connected or lost its last connection. We don't track
+       connected peers yet. *)
+    | "peerConnected" | "peerDisconnected" ->
+        Ok ()
     (* Received a message on some stream *)
     | "incomingStreamMsg" -> (
         let%bind m = Incoming_stream_msg.of_yojson v |> or_error in
@@ -625,6 +667,10 @@ module Helper = struct
           ~module_:__MODULE__ ~location:__LOC__
           ~metadata:[("error", `String m.reason); ("idx", `Int stream_idx)] ;
         Ok ()
+    (* The remote peer closed its write end of one of our streams. We wait for
+       the streamReadComplete that follows before closing the pipe. *)
+    | "streamRemoteClosed" ->
+        Ok ()
     (* The remote peer closed its write end of one of our streams *)
     | "streamReadComplete" -> (
         let%bind m = Stream_read_complete.of_yojson v |> or_error in
@@ -781,17 +827,13 @@ end
 type discovered_peer = {id: PeerID.t; maddrs: Multiaddr.t list}
 
 module Pubsub = struct
-  let publish net ~topic ~data =
-    match%map
-      Helper.do_rpc net
-        (module Helper.Rpcs.Publish)
-        {topic; data= to_b58_data data}
-      |> Deferred.Or_error.ok_exn
-    with
-    | "publish success" ->
-        ()
-    | v ->
-        failwithf "helper broke RPC protocol: publish got %s" v ()
+  type publish_result = Helper.Rpcs.Publish.output =
+    {message_id: string; peers: int}
+
+  let publish ?(require_peers = false) net ~topic ~data =
+    Helper.do_rpc net
+      (module Helper.Rpcs.Publish)
+      {topic; data= to_b64_data data; require_peers}
 
   module Subscription = struct
     type t = Helper.subscription =
@@ -1027,7 +1069,7 @@ let open_stream net ~protocol peer =
         (module Rpcs.Open_stream)
         {peer= PeerID.to_string peer; protocol})
   with
-  | Ok {stream_idx; remote_addr; remote_peerid} ->
+  | Ok {stream_idx; remote_addr; remote_peerid; protocol} ->
       let stream =
         Helper.make_stream net stream_idx protocol remote_addr remote_peerid
       in
@@ -1036,10 +1078,12 @@ let open_stream net ~protocol peer =
   | Error e ->
       Error e
 
-let add_peer net maddr =
+let add_peer ?(seed = false) net maddr =
   match%map
     Helper.(
-      do_rpc net (module Rpcs.Add_peer) {multiaddr= Multiaddr.to_string maddr})
+      do_rpc net
+        (module Rpcs.Add_peer)
+        {multiaddr= Multiaddr.to_string maddr; seed})
   with
   | Ok "addPeer success" ->
       Ok ()
@@ -1170,14 +1214,20 @@ let%test_module "coda network tests" =
         let b_r = Pubsub.Subscription.message_pipe b_sub in
         (* Give the subscriptions time to propagate *)
         let%bind () = after (sec 0.5) in
-        let%bind () = Pubsub.Subscription.publish a_sub "msg from a" in
+        let%bind _ =
+          Pubsub.Subscription.publish a_sub "msg from a"
+          |> Deferred.Or_error.ok_exn
+        in
         (* Give the publish time to propagate *)
         let%bind () = after (sec 0.5) in
         (* FIXME: a shouldn't be receiving its own messages? *)
         let%bind a_msg = Strict_pipe.Reader.read a_r in
         let%bind b_msg = Strict_pipe.Reader.read b_r in
         three_str_eq "msg from a" (unwrap_eof a_msg) (unwrap_eof b_msg) ;
-        let%bind () = Pubsub.Subscription.publish b_sub "msg from b" in
+        let%bind _ =
+          Pubsub.Subscription.publish b_sub "msg from b"
+          |> Deferred.Or_error.ok_exn
+        in
         (* Give the publish time to propagate *)
         let%bind () = after (sec 0.5) in
         let%bind a_msg = Strict_pipe.Reader.read a_r in
@@ -103,6 +103,10 @@ end
 type discovered_peer = {id: PeerID.t; maddrs: Multiaddr.t list}
 
 module Pubsub : sig
+  (** What a publish reports: the ID the message is traced under, and how
+      many peers it was sent to. *)
+  type publish_result = {message_id: string; peers: int}
+
   (** A subscription to a pubsub topic. *)
   module Subscription : sig
     type t
@@ -113,7 +117,7 @@ module Pubsub : sig
     * This function continues to work even if [unsubscribe t] has been called.
     * It is exactly [Pubsub.publish] with the topic this subscription was
     * created for, and fails in the same way. *)
-    val publish : t -> string -> unit Deferred.t
+    val publish : t -> string -> publish_result Deferred.Or_error.t
 
     (** Unsubscribe from this topic, closing the write pipe.
     *
@@ -128,9 +132,15 @@ module Pubsub : sig
   (** Publish a message to a topic.
   *
   * Returned deferred is resolved once the publish is enqueued.
-  * This can fail if signing the message failed.
+  * This can fail if signing the message failed, or if [require_peers] is
+  * set and no peers are subscribed to the topic.
   *  *)
-  val publish : net -> topic:string -> data:string -> unit Deferred.t
+  val publish :
+       ?require_peers:bool
+    -> net
+    -> topic:string
+    -> data:string
+    -> publish_result Deferred.Or_error.t
 
   (** Subscribe to a pubsub topic.
     *
@@ -289,8 +299,10 @@ val listening_addrs : net -> Multiaddr.t list Deferred.Or_error.t
 
 (** Connect to a peer, ensuring it enters our peerbook and DHT.
 
-  This can fail if the connection fails. *)
-val add_peer : net -> Multiaddr.t -> unit Deferred.Or_error.t
+  This can fail if the connection fails.
+
+  Seed peers are never pruned by the connection manager. *)
+val add_peer : ?seed:bool -> net -> Multiaddr.t -> unit Deferred.Or_error.t
 
 (** Join the DHT and announce our existence.
 
@@ -633,7 +633,8 @@ module Make (Rpc_intf : Coda_base.Rpc_intf.Rpc_interface_intf) :
                          ~f:(fun _ -> Coda_net2.begin_advertising net2)
                          (* TODO: timeouts here in addition to the libp2p side? *)
                          (Deferred.all
-                            (List.map ~f:(Coda_net2.add_peer net2)
+                            (List.map
+                               ~f:(Coda_net2.add_peer ~seed:true net2)
                                config.libp2p_peers)))
                     |> don't_wait_for ;
                     ()